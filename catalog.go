@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// CatalogLimit is a maximal amount of entries returned by the catalog endpoints
+const CatalogLimit = 1000
+
+// CatalogDataSource lists metrics and labels known to the data source in order to power autocomplete of query editors.
+// Empty metric means all metrics, all methods return only entries which start with the prefix
+type CatalogDataSource interface {
+	MetricNames(ctx context.Context, prefix string) ([]string, error)
+	LabelKeys(ctx context.Context, metric string, prefix string) ([]string, error)
+	LabelValues(ctx context.Context, metric string, label string, prefix string) ([]string, error)
+}
+
+// ErrCatalogNotSupported is returned by catalogs which can't list labels of the data source
+var ErrCatalogNotSupported = errors.New("catalog is not supported by the data source")
+
+// PanelLister lists all panels of the board
+type PanelLister interface {
+	ListPanels(ctx context.Context) ([]Panel, error)
+}
+
+type boardCatalog struct {
+	board  PanelLister
+	labels CatalogDataSource
+}
+
+// BoardCatalog returns catalog which lists panels of the board (matched by id or name) alongside metrics of the data
+// source catalog. Labels are served by the data source catalog only; if it's nil they are not supported
+func BoardCatalog(board PanelLister, labels CatalogDataSource) CatalogDataSource {
+	return boardCatalog{board: board, labels: labels}
+}
+
+func (c boardCatalog) MetricNames(ctx context.Context, prefix string) ([]string, error) {
+	panels, err := c.board.ListPanels(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list panels: %w", err)
+	}
+	names := make([]string, 0, len(panels))
+	for _, panel := range panels {
+		if strings.HasPrefix(panel.Id, prefix) || strings.HasPrefix(panel.Name, prefix) {
+			names = append(names, panel.Id)
+		}
+	}
+	if c.labels == nil {
+		return names, nil
+	}
+	metrics, err := c.labels.MetricNames(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return append(names, metrics...), nil
+}
+
+func (c boardCatalog) LabelKeys(ctx context.Context, metric string, prefix string) ([]string, error) {
+	if c.labels == nil {
+		return nil, ErrCatalogNotSupported
+	}
+	return c.labels.LabelKeys(ctx, metric, prefix)
+}
+
+func (c boardCatalog) LabelValues(ctx context.Context, metric string, label string, prefix string) ([]string, error) {
+	if c.labels == nil {
+		return nil, ErrCatalogNotSupported
+	}
+	return c.labels.LabelValues(ctx, metric, label, prefix)
+}
+
+// CatalogEntries returns sorted distinct entries which start with the prefix, at most CatalogLimit of them
+func CatalogEntries(entries []string, prefix string) []string {
+	matched := make([]string, 0)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, prefix) {
+			matched = append(matched, entry)
+		}
+	}
+	sort.Strings(matched)
+	matched = slices.Compact(matched)
+	return matched[:min(len(matched), CatalogLimit)]
+}
+
+// CatalogHandler serves /catalog/metrics, /catalog/labels and /catalog/values endpoints which accept metric, label
+// and prefix query parameters and respond with json array of strings. Catalog filters entries by the prefix itself
+func CatalogHandler(catalog CatalogDataSource) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		metric, label, prefix := query.Get("metric"), query.Get("label"), query.Get("prefix")
+		var (
+			entries []string
+			err     error
+		)
+		switch request.URL.Path {
+		case "/catalog/metrics":
+			entries, err = catalog.MetricNames(request.Context(), prefix)
+		case "/catalog/labels":
+			entries, err = catalog.LabelKeys(request.Context(), metric, prefix)
+		case "/catalog/values":
+			if label == "" {
+				http.Error(writer, "empty label", http.StatusBadRequest)
+				return
+			}
+			entries, err = catalog.LabelValues(request.Context(), metric, label, prefix)
+		default:
+			http.NotFound(writer, request)
+			return
+		}
+		if errors.Is(err, ErrCatalogNotSupported) {
+			http.Error(writer, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		if err != nil {
+			Logger.Errorf("catalog request failed: uri=%v, err=%v", request.RequestURI, err)
+			http.Error(writer, "catalog request failed", http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(writer).Encode(CatalogEntries(entries, ""))
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalog(t *testing.T) {
+	require.Equal(t, []string{"a", "ab"}, CatalogEntries([]string{"b", "ab", "a", "ab"}, "a"))
+
+	storage := NewMemoryStorage(0)
+	require.Nil(t, storage.Append("requests", "", map[string]string{"host": "a", "zone": "x"}, []uint64{1}, []float32{1}))
+	require.Nil(t, storage.Append("requests", "", map[string]string{"host": "b"}, []uint64{1}, []float32{1}))
+	require.Nil(t, storage.Append("errors", "", map[string]string{"host": "c", "code": "500"}, []uint64{1}, []float32{1}))
+	server := httptest.NewServer(CatalogHandler(storage))
+	defer server.Close()
+
+	get := func(uri string) (int, []string) {
+		response, err := http.Get(server.URL + uri)
+		require.Nil(t, err)
+		defer response.Body.Close()
+		var entries []string
+		if response.StatusCode == http.StatusOK {
+			require.Nil(t, json.NewDecoder(response.Body).Decode(&entries))
+		}
+		return response.StatusCode, entries
+	}
+	status, entries := get("/catalog/metrics")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []string{"errors", "requests"}, entries)
+	_, entries = get("/catalog/metrics?prefix=req")
+	require.Equal(t, []string{"requests"}, entries)
+	_, entries = get("/catalog/labels")
+	require.Equal(t, []string{"code", "host", "zone"}, entries)
+	_, entries = get("/catalog/labels?metric=requests")
+	require.Equal(t, []string{"host", "zone"}, entries)
+	_, entries = get("/catalog/values?label=host")
+	require.Equal(t, []string{"a", "b", "c"}, entries)
+	_, entries = get("/catalog/values?label=host&metric=requests&prefix=b")
+	require.Equal(t, []string{"b"}, entries)
+	status, _ = get("/catalog/values")
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = get("/catalog/series")
+	require.Equal(t, http.StatusNotFound, status)
+
+	// panels of the board are listed alongside metrics of the data source and matched by name as well
+	server = httptest.NewServer(CatalogHandler(BoardCatalog(MockMetricBoard{}, storage)))
+	defer server.Close()
+	_, entries = get("/catalog/metrics")
+	require.Equal(t, []string{"errors", "panel-id-1", "panel-id-2", "requests"}, entries)
+	_, entries = get("/catalog/metrics?prefix=panel+name+2")
+	require.Equal(t, []string{"panel-id-2"}, entries)
+	_, entries = get("/catalog/labels?metric=errors")
+	require.Equal(t, []string{"code", "host"}, entries)
+
+	server = httptest.NewServer(CatalogHandler(BoardCatalog(MockMetricBoard{}, nil)))
+	defer server.Close()
+	_, entries = get("/catalog/metrics?prefix=panel-id-")
+	require.Equal(t, []string{"panel-id-1", "panel-id-2"}, entries)
+	status, _ = get("/catalog/labels")
+	require.Equal(t, http.StatusNotImplemented, status)
+}
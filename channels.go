@@ -41,3 +41,18 @@ func NewStreamingReader[T any](ctx context.Context, capacity int, read func() (T
 	}()
 	return result
 }
+
+// ConsumeStream runs produce in a separate goroutine and calls consume for every produced item in the current goroutine.
+// Produce error is returned only after all items were consumed
+func ConsumeStream[T any](produce func(items chan<- T) error, consume func(T)) error {
+	items := make(chan T)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(items)
+		errs <- produce(items)
+	}()
+	for item := range items {
+		consume(item)
+	}
+	return <-errs
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	RateTransform       = "rate"
+	IncreaseTransform   = "increase"
+	DerivativeTransform = "derivative"
+)
+
+type counterPoint struct {
+	timestamp uint64
+	value     float32
+}
+
+// CounterTransform converts values of every series into the per-second rate or increase of the counter, or into the
+// per-second derivative of the gauge. The last point of every series is kept, so consecutive chunks of the same series
+// are transformed seamlessly; the very first point of the series is dropped since it has no predecessor.
+// The last point can be received again with recomputed value of its bucket, then it's transformed against its predecessor again
+type CounterTransform struct {
+	kind   string
+	last   map[string]counterPoint
+	before map[string]counterPoint // predecessor of the last point
+}
+
+func NewCounterTransform(kind string) (*CounterTransform, error) {
+	switch kind {
+	case RateTransform, IncreaseTransform, DerivativeTransform:
+	default:
+		return nil, fmt.Errorf("unknown transform: %v", kind)
+	}
+	return &CounterTransform{kind: kind, last: make(map[string]counterPoint), before: make(map[string]counterPoint)}, nil
+}
+
+func (c *CounterTransform) Apply(metric Metric) Metric {
+	key := metric.Key()
+	timestamps, values := make([]uint64, 0, len(metric.Timestamps)), make([]float32, 0, len(metric.Values))
+	previous, ok := c.last[key]
+	predecessor, hasPredecessor := c.before[key]
+	for i, timestamp := range metric.Timestamps {
+		value := metric.Values[i]
+		if math.IsNaN(float64(value)) {
+			continue
+		}
+		if ok && timestamp == previous.timestamp {
+			previous, ok = predecessor, hasPredecessor
+		}
+		if ok && timestamp <= previous.timestamp {
+			continue
+		}
+		if ok {
+			delta := float64(value) - float64(previous.value)
+			// counter can only decrease after reset, in this case it starts again from zero
+			if c.kind != DerivativeTransform && delta < 0 {
+				delta = float64(value)
+			}
+			seconds := float64(timestamp-previous.timestamp) / float64(time.Second.Microseconds())
+			if c.kind != IncreaseTransform {
+				delta /= seconds
+			}
+			timestamps, values = append(timestamps, timestamp), append(values, float32(delta))
+		}
+		predecessor, hasPredecessor = previous, ok
+		previous, ok = counterPoint{timestamp: timestamp, value: value}, true
+	}
+	if ok {
+		c.last[key] = previous
+	}
+	if hasPredecessor {
+		c.before[key] = predecessor
+	}
+	metric.Timestamps, metric.Values = timestamps, values
+	return metric
+}
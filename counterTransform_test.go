@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterTransform(t *testing.T) {
+	_, err := NewCounterTransform("integral")
+	require.NotNil(t, err)
+
+	second := uint64(time.Second.Microseconds())
+	counter := Metric{Type: InstanceMetricLineType, Timestamps: []uint64{0, second, 3 * second, 4 * second}, Values: []float32{10, 20, 40, 5}}
+
+	rate, err := NewCounterTransform(RateTransform)
+	require.Nil(t, err)
+	transformed := rate.Apply(counter)
+	require.Equal(t, []uint64{second, 3 * second, 4 * second}, transformed.Timestamps)
+	// irregular timestamps are respected and counter reset is treated as restart from zero
+	require.Equal(t, []float32{10, 10, 5}, transformed.Values)
+	// next chunk of the same series continues from the last point
+	transformed = rate.Apply(Metric{Type: InstanceMetricLineType, Timestamps: []uint64{6 * second}, Values: []float32{15}})
+	require.Equal(t, []float32{5}, transformed.Values)
+	// last point pushed again with recomputed value is transformed against its predecessor
+	transformed = rate.Apply(Metric{Type: InstanceMetricLineType, Timestamps: []uint64{6 * second, 7 * second}, Values: []float32{17, 20}})
+	require.Equal(t, []uint64{6 * second, 7 * second}, transformed.Timestamps)
+	require.Equal(t, []float32{6, 3}, transformed.Values)
+
+	increase, _ := NewCounterTransform(IncreaseTransform)
+	require.Equal(t, []float32{10, 20, 5}, increase.Apply(counter).Values)
+
+	derivative, _ := NewCounterTransform(DerivativeTransform)
+	require.Equal(t, []float32{10, 10, -35}, derivative.Apply(counter).Values)
+}
+
+func TestCounterPanelTransform(t *testing.T) {
+	dataSource := WithPanelTransforms(MockMetricBoard{}, staticPanels{"p": Panel{Id: "p", Transform: DerivativeTransform}})
+	metrics := make(chan Metric, 1)
+	query := MetricQuery{StartTime: time.UnixMicro(10_000_000), EndTime: time.UnixMicro(20_000_000), Resolution: time.Second}
+	require.Nil(t, dataSource.GetMetric(context.Background(), "p", query, metrics))
+	metric := <-metrics
+	// predecessor of the first point is loaded from the previous bucket, so all points of the query are present
+	require.Len(t, metric.Timestamps, 11)
+	require.Equal(t, uint64(10_000_000), metric.Timestamps[0])
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	AvgDownsample  = "avg"
+	MinDownsample  = "min"
+	MaxDownsample  = "max"
+	LastDownsample = "last"
+	LttbDownsample = "lttb"
+)
+
+type downsampleBucket struct {
+	timestamp      uint64
+	sum            float64
+	count          int
+	min, max, last float32
+}
+
+// bucketize groups points of the metric into buckets of the resolution size aligned to the epoch; NaN values are skipped
+func bucketize(metric Metric, resolution time.Duration) []downsampleBucket {
+	size := uint64(resolution.Microseconds())
+	buckets := make([]downsampleBucket, 0)
+	for i, timestamp := range metric.Timestamps {
+		value := metric.Values[i]
+		if math.IsNaN(float64(value)) {
+			continue
+		}
+		start := timestamp - timestamp%size
+		if len(buckets) == 0 || buckets[len(buckets)-1].timestamp != start {
+			buckets = append(buckets, downsampleBucket{timestamp: start, min: value, max: value})
+		}
+		current := &buckets[len(buckets)-1]
+		current.sum += float64(value)
+		current.count++
+		current.min = min(current.min, value)
+		current.max = max(current.max, value)
+		current.last = value
+	}
+	return buckets
+}
+
+// Crowded returns true if some bucket of the resolution size contains more than one point of the metric
+func Crowded(metric Metric, resolution time.Duration) bool {
+	size := uint64(resolution.Microseconds())
+	for i := 1; i < len(metric.Timestamps); i++ {
+		if metric.Timestamps[i]-metric.Timestamps[i]%size == metric.Timestamps[i-1]-metric.Timestamps[i-1]%size {
+			return true
+		}
+	}
+	return false
+}
+
+// DownsampleMetric aggregates points within every bucket of the resolution size with avg, min, max or last aggregate
+func DownsampleMetric(metric Metric, resolution time.Duration, aggregate string) Metric {
+	buckets := bucketize(metric, resolution)
+	metric.Timestamps = make([]uint64, len(buckets))
+	metric.Values = make([]float32, len(buckets))
+	for i, bucket := range buckets {
+		metric.Timestamps[i] = bucket.timestamp
+		switch aggregate {
+		case MinDownsample:
+			metric.Values[i] = bucket.min
+		case MaxDownsample:
+			metric.Values[i] = bucket.max
+		case LastDownsample:
+			metric.Values[i] = bucket.last
+		default:
+			metric.Values[i] = float32(bucket.sum / float64(bucket.count))
+		}
+	}
+	return metric
+}
+
+// MetricEnvelope returns lines of minimal and maximal values within every bucket of the resolution size
+func MetricEnvelope(metric Metric, resolution time.Duration) (Metric, Metric) {
+	buckets := bucketize(metric, resolution)
+	lower := Metric{PanelId: metric.PanelId, Type: EnvelopeMinMetricLineType, Group: metric.Group, Labels: metric.Labels, Timestamps: make([]uint64, len(buckets)), Values: make([]float32, len(buckets))}
+	upper := Metric{PanelId: metric.PanelId, Type: EnvelopeMaxMetricLineType, Group: metric.Group, Labels: metric.Labels, Timestamps: make([]uint64, len(buckets)), Values: make([]float32, len(buckets))}
+	for i, bucket := range buckets {
+		lower.Timestamps[i], lower.Values[i] = bucket.timestamp, bucket.min
+		upper.Timestamps[i], upper.Values[i] = bucket.timestamp, bucket.max
+	}
+	return lower, upper
+}
+
+// LTTB thins points with Largest-Triangle-Three-Buckets algorithm: first and last points are kept and from every
+// bucket in between the point which forms the largest triangle with the previously selected point and the average of the next bucket is picked
+func LTTB(timestamps []uint64, values []float32, threshold int) ([]uint64, []float32) {
+	n := len(timestamps)
+	if threshold >= n || threshold < 3 {
+		return timestamps, values
+	}
+	x := func(i int) float64 { return float64(timestamps[i] - timestamps[0]) }
+	y := func(i int) float64 { return float64(values[i]) }
+
+	sampledTimestamps := make([]uint64, 0, threshold)
+	sampledValues := make([]float32, 0, threshold)
+	sampledTimestamps, sampledValues = append(sampledTimestamps, timestamps[0]), append(sampledValues, values[0])
+	every := float64(n-2) / float64(threshold-2)
+	selected := 0
+	for i := 0; i < threshold-2; i++ {
+		nextStart, nextEnd := int(float64(i+1)*every)+1, min(int(float64(i+2)*every)+1, n)
+		var averageX, averageY float64
+		for j := nextStart; j < nextEnd; j++ {
+			averageX += x(j)
+			averageY += y(j)
+		}
+		averageX /= float64(nextEnd - nextStart)
+		averageY /= float64(nextEnd - nextStart)
+
+		currentStart, currentEnd := int(float64(i)*every)+1, int(float64(i+1)*every)+1
+		largest, largestArea := currentStart, -1.0
+		for j := currentStart; j < currentEnd; j++ {
+			area := math.Abs((x(selected)-averageX)*(y(j)-y(selected)) - (x(selected)-x(j))*(averageY-y(selected)))
+			if area > largestArea {
+				largest, largestArea = j, area
+			}
+		}
+		selected = largest
+		sampledTimestamps, sampledValues = append(sampledTimestamps, timestamps[selected]), append(sampledValues, values[selected])
+	}
+	return append(sampledTimestamps, timestamps[n-1]), append(sampledValues, values[n-1])
+}
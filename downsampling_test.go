@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownsampling(t *testing.T) {
+	metric := Metric{
+		PanelId:    "p",
+		Type:       InstanceMetricLineType,
+		Timestamps: []uint64{0, 400, 900, 1000, 1500, 2100},
+		Values:     []float32{1, 5, 3, float32(math.NaN()), 2, 7},
+	}
+	require.True(t, Crowded(metric, time.Millisecond))
+	require.False(t, Crowded(metric, 100*time.Microsecond))
+
+	require.Equal(t, []uint64{0, 1000, 2000}, DownsampleMetric(metric, time.Millisecond, AvgDownsample).Timestamps)
+	require.Equal(t, []float32{3, 2, 7}, DownsampleMetric(metric, time.Millisecond, AvgDownsample).Values)
+	require.Equal(t, []float32{1, 2, 7}, DownsampleMetric(metric, time.Millisecond, MinDownsample).Values)
+	require.Equal(t, []float32{5, 2, 7}, DownsampleMetric(metric, time.Millisecond, MaxDownsample).Values)
+	require.Equal(t, []float32{3, 2, 7}, DownsampleMetric(metric, time.Millisecond, LastDownsample).Values)
+
+	lower, upper := MetricEnvelope(metric, time.Millisecond)
+	require.Equal(t, EnvelopeMinMetricLineType, lower.Type)
+	require.Equal(t, []float32{1, 2, 7}, lower.Values)
+	require.Equal(t, EnvelopeMaxMetricLineType, upper.Type)
+	require.Equal(t, []float32{5, 2, 7}, upper.Values)
+}
+
+func TestLTTB(t *testing.T) {
+	timestamps := make([]uint64, 100)
+	values := make([]float32, 100)
+	for i := range timestamps {
+		timestamps[i] = uint64(i)
+	}
+	// single spike must survive thinning
+	values[42] = 100
+	sampledTimestamps, sampledValues := LTTB(timestamps, values, 10)
+	require.Len(t, sampledTimestamps, 10)
+	require.Equal(t, uint64(0), sampledTimestamps[0])
+	require.Equal(t, uint64(99), sampledTimestamps[9])
+	require.Contains(t, sampledValues, float32(100))
+
+	sampledTimestamps, _ = LTTB(timestamps, values, 200)
+	require.Len(t, sampledTimestamps, 100)
+}
+
+func TestPanelTransforms(t *testing.T) {
+	require.Nil(t, ValidatePanelTransforms(Panel{Downsample: LttbDownsample}))
+	require.NotNil(t, ValidatePanelTransforms(Panel{Downsample: "median"}))
+
+	dataSource := WithPanelTransforms(staticDataSource{
+		{Type: InstanceMetricLineType, Timestamps: []uint64{0, 500, 1000}, Values: []float32{1, 3, 5}},
+	}, staticPanels{"p": Panel{Id: "p", Downsample: MaxDownsample, Envelope: true}})
+	metrics := make(chan Metric, 4)
+	require.Nil(t, dataSource.GetMetric(context.Background(), "p", MetricQuery{Resolution: time.Millisecond}, metrics))
+	require.Len(t, metrics, 3)
+	require.Equal(t, []float32{3, 5}, (<-metrics).Values)
+	require.Equal(t, EnvelopeMinMetricLineType, (<-metrics).Type)
+	require.Equal(t, EnvelopeMaxMetricLineType, (<-metrics).Type)
+
+	_, streaming := WithPanelTransforms(NewMemoryStorage(0), staticPanels{}).(StreamingDataSource)
+	require.True(t, streaming)
+}
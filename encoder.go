@@ -3,13 +3,41 @@ package main
 import (
 	"encoding/binary"
 	"math"
+	"math/bits"
+	"strings"
 )
 
 const (
 	F32Bin = iota + 1
 	U64Bin
+	MetricFrameBin
+	U64DeltaBin
+	F32XorBin
 )
 
+// FrameEncoding describes column encodings negotiated with the client
+type FrameEncoding struct {
+	Timestamps func(values []uint64) []byte
+	Values     func(values []float32) []byte
+}
+
+var RawFrameEncoding = FrameEncoding{Timestamps: EncodeU64, Values: EncodeF32}
+
+// NegotiateFrameEncoding picks the most compact encodings among comma-separated list of encodings supported by the client.
+// Raw encodings are always supported
+func NegotiateFrameEncoding(accepted string) FrameEncoding {
+	encoding := RawFrameEncoding
+	for _, name := range strings.Split(accepted, ",") {
+		switch strings.TrimSpace(name) {
+		case "u64-delta":
+			encoding.Timestamps = EncodeU64Delta
+		case "f32-xor":
+			encoding.Values = EncodeF32Xor
+		}
+	}
+	return encoding
+}
+
 func EncodeU64(values []uint64) []byte {
 	// version + length + content
 	bin := make([]byte, 1+4+len(values)*8)
@@ -31,3 +59,98 @@ func EncodeF32(values []float32) []byte {
 	}
 	return bin
 }
+
+// EncodeMetricFrame packs metric update into single self-describing frame in order to avoid interleaving of messages
+// between concurrent writers: version + header length + json header + timestamps column + values column
+func EncodeMetricFrame(encoding FrameEncoding, header []byte, timestamps []uint64, values []float32) []byte {
+	bin := make([]byte, 1+4, 1+4+len(header)+1+4+len(timestamps)*8+1+4+len(values)*4)
+	bin[0] = MetricFrameBin
+	binary.LittleEndian.PutUint32(bin[1:], uint32(len(header)))
+	bin = append(bin, header...)
+	bin = append(bin, encoding.Timestamps(timestamps)...)
+	bin = append(bin, encoding.Values(values)...)
+	return bin
+}
+
+func EncodeU64Delta(values []uint64) []byte {
+	// version + length + first value (uvarint) + first delta (varint) + delta-of-deltas (varint)
+	bin := make([]byte, 1+4, 1+4+2*len(values))
+	bin[0] = U64DeltaBin
+	binary.LittleEndian.PutUint32(bin[1:], uint32(len(values)))
+	var previous, previousDelta int64
+	for i, value := range values {
+		switch i {
+		case 0:
+			bin = binary.AppendUvarint(bin, value)
+		case 1:
+			previousDelta = int64(value) - previous
+			bin = binary.AppendVarint(bin, previousDelta)
+		default:
+			delta := int64(value) - previous
+			bin = binary.AppendVarint(bin, delta-previousDelta)
+			previousDelta = delta
+		}
+		previous = int64(value)
+	}
+	return bin
+}
+
+type bitWriter struct {
+	bin  []byte
+	free int
+}
+
+// write appends n least significant bits of value starting from the most significant one
+func (w *bitWriter) write(value uint32, n int) {
+	for n > 0 {
+		if w.free == 0 {
+			w.bin = append(w.bin, 0)
+			w.free = 8
+		}
+		chunk := min(n, w.free)
+		head := (value >> (n - chunk)) & (1<<chunk - 1)
+		w.bin[len(w.bin)-1] |= byte(head << (w.free - chunk))
+		w.free -= chunk
+		n -= chunk
+	}
+}
+
+func EncodeF32Xor(values []float32) []byte {
+	// version + length + bit stream of xor-ed values (Gorilla encoding adapted for 32-bit floats):
+	// - first value is written as is
+	// - '0' if value is the same as previous
+	// - '10' + meaningful bits if xor fits into previous leading/trailing zeros window
+	// - '11' + 5 bits of leading zeros + 5 bits of (meaningful bits count - 1) + meaningful bits otherwise
+	writer := &bitWriter{bin: make([]byte, 1+4, 1+4+len(values)*4)}
+	writer.bin[0] = F32XorBin
+	binary.LittleEndian.PutUint32(writer.bin[1:], uint32(len(values)))
+	var previous uint32
+	previousLeading, previousTrailing := -1, -1
+	for i, value := range values {
+		current := math.Float32bits(value)
+		if i == 0 {
+			writer.write(current, 32)
+			previous = current
+			continue
+		}
+		xor := current ^ previous
+		previous = current
+		if xor == 0 {
+			writer.write(0, 1)
+			continue
+		}
+		leading, trailing := bits.LeadingZeros32(xor), bits.TrailingZeros32(xor)
+		if previousLeading != -1 && leading >= previousLeading && trailing >= previousTrailing {
+			writer.write(0b10, 2)
+			writer.write(xor>>previousTrailing, 32-previousLeading-previousTrailing)
+			continue
+		}
+		meaningful := 32 - leading - trailing
+		writer.write(0b11, 2)
+		writer.write(uint32(leading), 5)
+		writer.write(uint32(meaningful-1), 5)
+		writer.write(xor>>trailing, meaningful)
+		previousLeading, previousTrailing = leading, trailing
+	}
+	return writer.bin
+}
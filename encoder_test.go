@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func decodeU64Delta(t *testing.T, bin []byte) []uint64 {
+	require.Equal(t, byte(U64DeltaBin), bin[0])
+	length := int(binary.LittleEndian.Uint32(bin[1:]))
+	bin = bin[5:]
+	values := make([]uint64, 0, length)
+	var previous, delta int64
+	for i := 0; i < length; i++ {
+		if i == 0 {
+			value, n := binary.Uvarint(bin)
+			bin = bin[n:]
+			previous = int64(value)
+		} else {
+			value, n := binary.Varint(bin)
+			bin = bin[n:]
+			if i == 1 {
+				delta = value
+			} else {
+				delta += value
+			}
+			previous += delta
+		}
+		values = append(values, uint64(previous))
+	}
+	require.Empty(t, bin)
+	return values
+}
+
+func decodeF32Xor(t *testing.T, bin []byte) []float32 {
+	require.Equal(t, byte(F32XorBin), bin[0])
+	length := int(binary.LittleEndian.Uint32(bin[1:]))
+	bin = bin[5:]
+	position := 0
+	read := func(n int) uint32 {
+		result := uint32(0)
+		for i := 0; i < n; i++ {
+			bit := (bin[position/8] >> (7 - position%8)) & 1
+			result = result<<1 | uint32(bit)
+			position++
+		}
+		return result
+	}
+	values := make([]float32, 0, length)
+	var previous uint32
+	leading, trailing := 0, 0
+	for i := 0; i < length; i++ {
+		if i == 0 {
+			previous = read(32)
+		} else if read(1) == 1 {
+			if read(1) == 1 {
+				leading = int(read(5))
+				trailing = 32 - leading - int(read(5)) - 1
+			}
+			previous ^= read(32-leading-trailing) << trailing
+		}
+		values = append(values, math.Float32frombits(previous))
+	}
+	require.Equal(t, (position+7)/8, len(bin))
+	return values
+}
+
+func TestEncoder(t *testing.T) {
+	t.Run("u64 delta", func(t *testing.T) {
+		for _, values := range [][]uint64{
+			{},
+			{42},
+			{1700000000_000000, 1700000001_000000},
+			{1700000000_000000, 1700000001_000000, 1700000002_000000, 1700000003_000000, 1700000005_000000, 1700000004_000000},
+		} {
+			bin := EncodeU64Delta(values)
+			require.Equal(t, values, decodeU64Delta(t, bin))
+		}
+		regular := make([]uint64, 100_000)
+		for i := range regular {
+			regular[i] = 1700000000_000000 + uint64(i)*1_000_000
+		}
+		bin := EncodeU64Delta(regular)
+		require.Equal(t, regular, decodeU64Delta(t, bin))
+		require.Less(t, len(bin), len(regular)+32)
+	})
+	t.Run("f32 xor", func(t *testing.T) {
+		for _, values := range [][]float32{
+			{},
+			{1.5},
+			{1, 1, 1, 2, 2, -3.25, float32(math.Inf(1)), 0, 0.1, 0.2, 0.30000001},
+		} {
+			require.Equal(t, values, decodeF32Xor(t, EncodeF32Xor(values)))
+		}
+		sine := make([]float32, 10_000)
+		for i := range sine {
+			sine[i] = float32(math.Round(100*math.Sin(float64(i)/100)) / 4)
+		}
+		bin := EncodeF32Xor(sine)
+		require.Equal(t, sine, decodeF32Xor(t, bin))
+		require.Less(t, len(bin), len(EncodeF32(sine))/2)
+	})
+	t.Run("negotiation", func(t *testing.T) {
+		encoding := NegotiateFrameEncoding("u64-delta, unknown")
+		require.Equal(t, byte(U64DeltaBin), encoding.Timestamps([]uint64{1})[0])
+		require.Equal(t, byte(F32Bin), encoding.Values([]float32{1})[0])
+		encoding = NegotiateFrameEncoding("")
+		require.Equal(t, byte(U64Bin), encoding.Timestamps([]uint64{1})[0])
+	})
+}
@@ -53,3 +53,23 @@ func EnvTryParseBool(key string) bool {
 	}
 	return false
 }
+
+func EnvTryParseString(key string, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func EnvTryParseInt(key string, defaultValue int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	integer, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		Logger.Fatalf("failed to parse integer: key=%v, value=%v", key, value)
+	}
+	return integer
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// MaxExplorePanels is a limit of ad-hoc panels within the single explore session
+const MaxExplorePanels = 16
+
+// ExploreMetricBoard overlays ad-hoc panels of the explore session over panels of the board.
+// Data sources must be constructed on top of the overlay in order to see ad-hoc panels
+type ExploreMetricBoard struct {
+	MetricBoard
+	// allowQueries permits raw data source queries in ad-hoc panels; otherwise only expressions over saved panels are accepted
+	allowQueries bool
+	lock         sync.RWMutex
+	panels       map[string]Panel
+}
+
+func NewExploreMetricBoard(board MetricBoard, allowQueries bool) *ExploreMetricBoard {
+	return &ExploreMetricBoard{MetricBoard: board, allowQueries: allowQueries, panels: make(map[string]Panel)}
+}
+
+func (b *ExploreMetricBoard) GetPanel(ctx context.Context, panelId string) (Panel, error) {
+	b.lock.RLock()
+	panel, ok := b.panels[panelId]
+	b.lock.RUnlock()
+	if ok {
+		return panel, nil
+	}
+	return b.MetricBoard.GetPanel(ctx, panelId)
+}
+
+// Explore replaces all ad-hoc panels of the session and returns panels update which activates them and resets
+// new, changed and removed panels, so cache of the previous definition with the same id is never reused
+func (b *ExploreMetricBoard) Explore(command MetricBoardExploreCommand) (MetricBoardPanelsUpdateCommand, error) {
+	if len(command.Panels) > MaxExplorePanels {
+		return MetricBoardPanelsUpdateCommand{}, fmt.Errorf("too many explore panels: %v > %v", len(command.Panels), MaxExplorePanels)
+	}
+	panels := make(map[string]Panel, len(command.Panels))
+	for _, panel := range command.Panels {
+		if panel.Id == "" {
+			return MetricBoardPanelsUpdateCommand{}, fmt.Errorf("empty explore panel id")
+		}
+		if _, ok := panels[panel.Id]; ok {
+			return MetricBoardPanelsUpdateCommand{}, fmt.Errorf("duplicate explore panel id: id=%v", panel.Id)
+		}
+		if panel.Query != "" && !b.allowQueries {
+			return MetricBoardPanelsUpdateCommand{}, fmt.Errorf("raw queries are disabled for explore panels: id=%v", panel.Id)
+		}
+		if err := ValidatePanelTransforms(panel); err != nil {
+			return MetricBoardPanelsUpdateCommand{}, fmt.Errorf("invalid explore panel transforms: id=%v, err=%w", panel.Id, err)
+		}
+		if panel.Expression != "" {
+			if _, err := ParseExpression(panel.Expression); err != nil {
+				return MetricBoardPanelsUpdateCommand{}, fmt.Errorf("invalid explore panel expression: id=%v, err=%w", panel.Id, err)
+			}
+		}
+		panels[panel.Id] = panel
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	update := MetricBoardPanelsUpdateCommand{ActivePanelIds: make([]string, 0, len(command.Panels)), ResetPanelIds: make([]string, 0)}
+	for _, panel := range command.Panels {
+		update.ActivePanelIds = append(update.ActivePanelIds, panel.Id)
+		if previous, ok := b.panels[panel.Id]; !ok || previous != panel {
+			update.ResetPanelIds = append(update.ResetPanelIds, panel.Id)
+		}
+	}
+	for panelId := range b.panels {
+		if _, ok := panels[panelId]; !ok {
+			update.ResetPanelIds = append(update.ResetPanelIds, panelId)
+		}
+	}
+	b.panels = panels
+	return update, nil
+}
+
+// ExploreCommands applies explore commands of the session to the board and forwards them to SubscribeToPanels as
+// panels updates, so ad-hoc panels share caching, prioritization and streaming with the saved ones
+func ExploreCommands(ctx context.Context, board *ExploreMetricBoard, commands <-chan MetricBoardCommands, results chan<- MetricResult) <-chan MetricBoardCommands {
+	forwarded := make(chan MetricBoardCommands)
+	go func() {
+		defer close(forwarded)
+		for {
+			var command MetricBoardCommands
+			select {
+			case <-ctx.Done():
+				return
+			case received, ok := <-commands:
+				if !ok {
+					return
+				}
+				command = received
+			}
+			if command.ExploreUpdate != nil {
+				update, err := board.Explore(*command.ExploreUpdate)
+				if err != nil {
+					select {
+					case <-ctx.Done():
+						return
+					case results <- MetricResult{RequestId: command.Id, Err: err}:
+					}
+					continue
+				}
+				if command.PanelsUpdate != nil {
+					update.VisiblePanelIds = command.PanelsUpdate.VisiblePanelIds
+					update.Filters = command.PanelsUpdate.Filters
+					update.ResetPanelIds = append(update.ResetPanelIds, command.PanelsUpdate.ResetPanelIds...)
+				}
+				slices.Sort(update.ResetPanelIds)
+				update.ResetPanelIds = slices.Compact(update.ResetPanelIds)
+				command.PanelsUpdate = &update
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case forwarded <- command:
+			}
+		}
+	}()
+	return forwarded
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExploreMetricBoard(t *testing.T) {
+	board := NewExploreMetricBoard(MockMetricBoard{}, true)
+	update, err := board.Explore(MetricBoardExploreCommand{Panels: []Panel{{Id: "x", Query: "up"}, {Id: "y", Expression: "x * 2"}}})
+	require.Nil(t, err)
+	require.Equal(t, []string{"x", "y"}, update.ActivePanelIds)
+	require.Equal(t, []string{"x", "y"}, update.ResetPanelIds)
+	panel, err := board.GetPanel(context.Background(), "x")
+	require.Nil(t, err)
+	require.Equal(t, "up", panel.Query)
+
+	update, err = board.Explore(MetricBoardExploreCommand{Panels: []Panel{{Id: "x", Query: "up"}, {Id: "y", Expression: "x * 3"}}})
+	require.Nil(t, err)
+	require.Equal(t, []string{"y"}, update.ResetPanelIds)
+
+	// saved panels are still available while ad-hoc ones are replaced
+	update, err = board.Explore(MetricBoardExploreCommand{Panels: []Panel{{Id: "y", Expression: "x * 3"}}})
+	require.Nil(t, err)
+	require.Equal(t, []string{"x"}, update.ResetPanelIds)
+	panel, err = board.GetPanel(context.Background(), "x")
+	require.Nil(t, err)
+	require.Equal(t, "", panel.Query)
+
+	// panel which was removed and added back with the same id is reloaded from scratch
+	update, err = board.Explore(MetricBoardExploreCommand{Panels: []Panel{{Id: "x", Query: "up"}, {Id: "y", Expression: "x * 3"}}})
+	require.Nil(t, err)
+	require.Equal(t, []string{"x"}, update.ResetPanelIds)
+
+	for _, invalid := range [][]Panel{
+		{{Id: ""}},
+		{{Id: "x"}, {Id: "x"}},
+		{{Id: "x", Expression: "x +"}},
+		{{Id: "x", Transform: "integral"}},
+		make([]Panel, MaxExplorePanels+1),
+	} {
+		_, err := board.Explore(MetricBoardExploreCommand{Panels: invalid})
+		require.NotNil(t, err)
+	}
+
+	// without explicit permission only expressions over saved panels are accepted
+	restricted := NewExploreMetricBoard(MockMetricBoard{}, false)
+	_, err = restricted.Explore(MetricBoardExploreCommand{Panels: []Panel{{Id: "x", Query: "DROP TABLE metrics"}}})
+	require.NotNil(t, err)
+	_, err = restricted.Explore(MetricBoardExploreCommand{Panels: []Panel{{Id: "x", Expression: `"panel-id-1" * 2`}}})
+	require.Nil(t, err)
+}
+
+func TestExploreSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	explore := NewExploreMetricBoard(MockMetricBoard{}, false)
+	session := WithDataSource(explore, WithExpressions(explore, explore))
+	commands := make(chan MetricBoardCommands)
+	results := make(chan MetricResult, 1024)
+	go SubscribeToPanels(ctx, session, newTestWorkerPool(t), []string{}, nil, ExploreCommands(ctx, explore, commands, results), results)
+
+	commands <- MetricBoardCommands{
+		Id:            "1",
+		TimeUpdate:    &MetricBoardTimeUpdateCommand{Start: 1_000_000, End: 5_000_000, Resolution: 1_000_000},
+		ExploreUpdate: &MetricBoardExploreCommand{Panels: []Panel{{Id: "doubled", Expression: `"panel-id-1" * 2`}}},
+	}
+	points := 0
+	for _, result := range receiveUntilComplete(t, results, "1") {
+		require.Nil(t, result.Err)
+		if result.Metric.Timestamps != nil {
+			require.Equal(t, "doubled", result.PanelId)
+			points += len(result.Metric.Timestamps)
+		}
+	}
+	require.Equal(t, 5, points)
+
+	commands <- MetricBoardCommands{Id: "2", ExploreUpdate: &MetricBoardExploreCommand{Panels: []Panel{{Id: "broken", Expression: "("}}}}
+	received := receiveUntil(t, results, func(result MetricResult) bool { return result.RequestId == "2" })
+	require.NotNil(t, received[len(received)-1].Err)
+}
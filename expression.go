@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type ExpressionType int
+
+const (
+	ScalarExpressionType ExpressionType = iota + 1
+	VectorExpressionType
+)
+
+func (t ExpressionType) String() string {
+	switch t {
+	case ScalarExpressionType:
+		return "scalar"
+	case VectorExpressionType:
+		return "vector"
+	}
+	return "unknown"
+}
+
+// Expression is a node of the parsed panel expression. Expressions are type checked during parsing:
+// scalars are constants, vectors are sets of series loaded from other panels
+type Expression interface {
+	Type() ExpressionType
+}
+
+type numberExpression struct {
+	value float64
+}
+
+// selectorExpression loads all series of the panel shifted back in time by offset
+type selectorExpression struct {
+	panelId string
+	offset  time.Duration
+}
+
+type negationExpression struct {
+	operand Expression
+}
+
+type binaryExpression struct {
+	operator    byte
+	left, right Expression
+}
+
+type callExpression struct {
+	function  string
+	arguments []Expression
+}
+
+type aggregateExpression struct {
+	aggregate string
+	by        []string
+	operand   Expression
+}
+
+func (e numberExpression) Type() ExpressionType   { return ScalarExpressionType }
+func (e selectorExpression) Type() ExpressionType { return VectorExpressionType }
+func (e negationExpression) Type() ExpressionType { return e.operand.Type() }
+func (e aggregateExpression) Type() ExpressionType {
+	return VectorExpressionType
+}
+func (e binaryExpression) Type() ExpressionType {
+	if e.left.Type() == VectorExpressionType || e.right.Type() == VectorExpressionType {
+		return VectorExpressionType
+	}
+	return ScalarExpressionType
+}
+func (e callExpression) Type() ExpressionType {
+	if counterFunctions[e.function] {
+		return VectorExpressionType
+	}
+	return e.arguments[0].Type()
+}
+
+// counterFunctions are evaluated with CounterTransform of the same name
+var counterFunctions = map[string]bool{RateTransform: true, IncreaseTransform: true, DerivativeTransform: true}
+
+// scalarFunctions are applied to every value of the argument; clamp functions accept scalar bound as the second argument
+var scalarFunctions = map[string]int{
+	"abs": 1, "sqrt": 1, "ln": 1, "log10": 1, "exp": 1, "ceil": 1, "floor": 1, "round": 1,
+	"clamp_min": 2, "clamp_max": 2,
+}
+
+var aggregates = []string{"sum", "avg", "min", "max", "count"}
+
+type expressionToken struct {
+	kind     byte // 'n' - number, 'i' - identifier, 's' - string, 'd' - duration or the operator itself
+	text     string
+	position int
+}
+
+func tokenizeExpression(expression string) ([]expressionToken, error) {
+	tokens := make([]expressionToken, 0)
+	for i := 0; i < len(expression); {
+		c := rune(expression[i])
+		start := i
+		switch {
+		case unicode.IsSpace(c):
+			i++
+			continue
+		case strings.ContainsRune("+-*/(),", c):
+			tokens = append(tokens, expressionToken{kind: byte(c), text: string(c), position: start})
+			i++
+		case c == '"':
+			i++
+			for i < len(expression) && expression[i] != '"' {
+				if expression[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(expression) {
+				return nil, fmt.Errorf("unterminated string at %v", start)
+			}
+			i++
+			text, err := strconv.Unquote(expression[start:i])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %v: %w", start, err)
+			}
+			tokens = append(tokens, expressionToken{kind: 's', text: text, position: start})
+		case unicode.IsDigit(c):
+			for i < len(expression) && (unicode.IsDigit(rune(expression[i])) || expression[i] == '.') {
+				i++
+			}
+			kind := byte('n')
+			for i < len(expression) && (unicode.IsLetter(rune(expression[i])) || unicode.IsDigit(rune(expression[i]))) {
+				kind = 'd'
+				i++
+			}
+			tokens = append(tokens, expressionToken{kind: kind, text: expression[start:i], position: start})
+		case unicode.IsLetter(c) || c == '_':
+			for i < len(expression) && (unicode.IsLetter(rune(expression[i])) || unicode.IsDigit(rune(expression[i])) || strings.ContainsRune("_:.", rune(expression[i]))) {
+				i++
+			}
+			tokens = append(tokens, expressionToken{kind: 'i', text: expression[start:i], position: start})
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' at %v", c, start)
+		}
+	}
+	return tokens, nil
+}
+
+// parseExpressionDuration parses duration of the offset which additionally supports days and weeks: 1d, 2w
+func parseExpressionDuration(text string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if amount, ok := strings.CutSuffix(text, suffix); ok {
+			if value, err := strconv.Atoi(amount); err == nil {
+				return time.Duration(value) * unit, nil
+			}
+		}
+	}
+	return time.ParseDuration(text)
+}
+
+type expressionParser struct {
+	tokens   []expressionToken
+	position int
+}
+
+func (p *expressionParser) peek() expressionToken {
+	if p.position == len(p.tokens) {
+		return expressionToken{kind: 0, text: "end of expression", position: -1}
+	}
+	return p.tokens[p.position]
+}
+
+func (p *expressionParser) next() expressionToken {
+	token := p.peek()
+	if p.position < len(p.tokens) {
+		p.position++
+	}
+	return token
+}
+
+func (p *expressionParser) expect(kind byte) (expressionToken, error) {
+	token := p.next()
+	if token.kind != kind {
+		return token, fmt.Errorf("unexpected '%v' at %v, expected '%c'", token.text, token.position, kind)
+	}
+	return token, nil
+}
+
+// parseBinary parses left-associative chain of binary operators of the same precedence
+func (p *expressionParser) parseBinary(operators string, operand func() (Expression, error)) (Expression, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind != 0 && strings.IndexByte(operators, p.peek().kind) != -1 {
+		operator := p.next().kind
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpression{operator: operator, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) parseSum() (Expression, error) {
+	return p.parseBinary("+-", p.parseProduct)
+}
+
+func (p *expressionParser) parseProduct() (Expression, error) {
+	return p.parseBinary("*/", p.parseUnary)
+}
+
+func (p *expressionParser) parseUnary() (Expression, error) {
+	if p.peek().kind == '-' {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negationExpression{operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *expressionParser) parseArguments() ([]Expression, error) {
+	if _, err := p.expect('('); err != nil {
+		return nil, err
+	}
+	arguments := make([]Expression, 0)
+	for {
+		argument, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		arguments = append(arguments, argument)
+		if p.peek().kind != ',' {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(')'); err != nil {
+		return nil, err
+	}
+	return arguments, nil
+}
+
+func (p *expressionParser) parseSelector(panelId string) (Expression, error) {
+	selector := selectorExpression{panelId: panelId}
+	if p.peek().kind == 'i' && p.peek().text == "offset" {
+		p.next()
+		token, err := p.expect('d')
+		if err != nil {
+			return nil, err
+		}
+		if selector.offset, err = parseExpressionDuration(token.text); err != nil {
+			return nil, fmt.Errorf("invalid offset at %v: %w", token.position, err)
+		}
+	}
+	return selector, nil
+}
+
+func (p *expressionParser) parsePrimary() (Expression, error) {
+	token := p.next()
+	switch token.kind {
+	case 'n':
+		value, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number at %v: %w", token.position, err)
+		}
+		return numberExpression{value: value}, nil
+	case 's':
+		return p.parseSelector(token.text)
+	case '(':
+		inner, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	case 'i':
+		if slices.Contains(aggregates, token.text) {
+			return p.parseAggregate(token)
+		}
+		if p.peek().kind != '(' {
+			return p.parseSelector(token.text)
+		}
+		arguments, err := p.parseArguments()
+		if err != nil {
+			return nil, err
+		}
+		if counterFunctions[token.text] {
+			if len(arguments) != 1 || arguments[0].Type() != VectorExpressionType {
+				return nil, fmt.Errorf("function %v at %v expects single vector argument", token.text, token.position)
+			}
+			return callExpression{function: token.text, arguments: arguments}, nil
+		}
+		arity, ok := scalarFunctions[token.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %v at %v", token.text, token.position)
+		}
+		if len(arguments) != arity {
+			return nil, fmt.Errorf("function %v at %v expects %v arguments, got %v", token.text, token.position, arity, len(arguments))
+		}
+		if arity == 2 && arguments[1].Type() != ScalarExpressionType {
+			return nil, fmt.Errorf("function %v at %v expects scalar bound", token.text, token.position)
+		}
+		return callExpression{function: token.text, arguments: arguments}, nil
+	}
+	return nil, fmt.Errorf("unexpected '%v' at %v", token.text, token.position)
+}
+
+// parseAggregate parses aggregation in the form: sum by (label, ...) (vector)
+func (p *expressionParser) parseAggregate(token expressionToken) (Expression, error) {
+	aggregate := aggregateExpression{aggregate: token.text, by: make([]string, 0)}
+	if p.peek().kind == 'i' && p.peek().text == "by" {
+		p.next()
+		if _, err := p.expect('('); err != nil {
+			return nil, err
+		}
+		for {
+			label, err := p.expect('i')
+			if err != nil {
+				return nil, err
+			}
+			aggregate.by = append(aggregate.by, label.text)
+			if p.peek().kind != ',' {
+				break
+			}
+			p.next()
+		}
+		if _, err := p.expect(')'); err != nil {
+			return nil, err
+		}
+	}
+	arguments, err := p.parseArguments()
+	if err != nil {
+		return nil, err
+	}
+	if len(arguments) != 1 || arguments[0].Type() != VectorExpressionType {
+		return nil, fmt.Errorf("aggregate %v at %v expects single vector argument", token.text, token.position)
+	}
+	aggregate.operand = arguments[0]
+	return aggregate, nil
+}
+
+// ParseExpression parses and type checks panel expression. Grammar:
+//
+//	expression := product (('+' | '-') product)*
+//	product    := unary (('*' | '/') unary)*
+//	unary      := '-' unary | primary
+//	primary    := number | selector | function '(' expression, ... ')' | aggregate ['by' '(' label, ... ')'] '(' expression ')' | '(' expression ')'
+//	selector   := (identifier | "panel id") ['offset' duration]
+func ParseExpression(expression string) (Expression, error) {
+	tokens, err := tokenizeExpression(expression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tokenize expression: %w", err)
+	}
+	parser := &expressionParser{tokens: tokens}
+	parsed, err := parser.parseSum()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse expression: %w", err)
+	}
+	if token := parser.peek(); token.kind != 0 {
+		return nil, fmt.Errorf("failed to parse expression: unexpected '%v' at %v", token.text, token.position)
+	}
+	return parsed, nil
+}
+
+// ExpressionPanels returns ids of the panels selected by the expression
+func ExpressionPanels(expression Expression) []string {
+	switch e := expression.(type) {
+	case selectorExpression:
+		return []string{e.panelId}
+	case negationExpression:
+		return ExpressionPanels(e.operand)
+	case binaryExpression:
+		return append(ExpressionPanels(e.left), ExpressionPanels(e.right)...)
+	case callExpression:
+		panels := make([]string, 0)
+		for _, argument := range e.arguments {
+			panels = append(panels, ExpressionPanels(argument)...)
+		}
+		return panels
+	case aggregateExpression:
+		return ExpressionPanels(e.operand)
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const MaxExpressionDepth = 8
+
+// ErrStreamingNotSupported is returned by Subscribe for panels which can be only polled
+var ErrStreamingNotSupported = errors.New("streaming is not supported")
+
+type expressionDepthKey struct{}
+
+// expressionSeries is an instance series of the evaluated vector with points aligned to the resolution grid
+type expressionSeries struct {
+	labels map[string]string
+	points map[uint64]float64
+}
+
+func (s expressionSeries) mapValues(apply func(value float64) float64) expressionSeries {
+	points := make(map[uint64]float64, len(s.points))
+	for timestamp, value := range s.points {
+		points[timestamp] = apply(value)
+	}
+	return expressionSeries{labels: s.labels, points: points}
+}
+
+func (s expressionSeries) metric(panelId string) Metric {
+	metric := Metric{PanelId: panelId, Type: InstanceMetricLineType, Labels: s.labels, Timestamps: make([]uint64, 0, len(s.points)), Values: make([]float32, 0, len(s.points))}
+	for timestamp := range s.points {
+		metric.Timestamps = append(metric.Timestamps, timestamp)
+	}
+	sort.Slice(metric.Timestamps, func(i, j int) bool { return metric.Timestamps[i] < metric.Timestamps[j] })
+	for _, timestamp := range metric.Timestamps {
+		metric.Values = append(metric.Values, float32(s.points[timestamp]))
+	}
+	return metric
+}
+
+func applyOperator(operator byte, left, right float64) float64 {
+	switch operator {
+	case '+':
+		return left + right
+	case '-':
+		return left - right
+	case '*':
+		return left * right
+	}
+	return left / right
+}
+
+func applyFunction(function string, value, bound float64) float64 {
+	switch function {
+	case "abs":
+		return math.Abs(value)
+	case "sqrt":
+		return math.Sqrt(value)
+	case "ln":
+		return math.Log(value)
+	case "log10":
+		return math.Log10(value)
+	case "exp":
+		return math.Exp(value)
+	case "ceil":
+		return math.Ceil(value)
+	case "floor":
+		return math.Floor(value)
+	case "round":
+		return math.Round(value)
+	case "clamp_min":
+		return math.Max(value, bound)
+	case "clamp_max":
+		return math.Min(value, bound)
+	}
+	return math.NaN()
+}
+
+// evaluateScalar computes value of the scalar expression which never depends on the data
+func evaluateScalar(expression Expression) float64 {
+	switch e := expression.(type) {
+	case numberExpression:
+		return e.value
+	case negationExpression:
+		return -evaluateScalar(e.operand)
+	case binaryExpression:
+		return applyOperator(e.operator, evaluateScalar(e.left), evaluateScalar(e.right))
+	case callExpression:
+		bound := 0.0
+		if len(e.arguments) > 1 {
+			bound = evaluateScalar(e.arguments[1])
+		}
+		return applyFunction(e.function, evaluateScalar(e.arguments[0]), bound)
+	}
+	return math.NaN()
+}
+
+// matchSeries applies the operator to the points with the same timestamp of the series with the same labels.
+// If one of the operands consists of the single series it is applied to every series of the other operand
+func matchSeries(operator byte, left, right []expressionSeries) []expressionSeries {
+	join := func(left, right expressionSeries, labels map[string]string) expressionSeries {
+		points := make(map[uint64]float64)
+		for timestamp, value := range left.points {
+			if other, ok := right.points[timestamp]; ok {
+				points[timestamp] = applyOperator(operator, value, other)
+			}
+		}
+		return expressionSeries{labels: labels, points: points}
+	}
+	matched := make([]expressionSeries, 0)
+	switch {
+	case len(right) == 1:
+		for _, series := range left {
+			matched = append(matched, join(series, right[0], series.labels))
+		}
+	case len(left) == 1:
+		for _, series := range right {
+			matched = append(matched, join(left[0], series, series.labels))
+		}
+	default:
+		rightByLabels := make(map[string]expressionSeries, len(right))
+		for _, series := range right {
+			rightByLabels[LabelsKey(series.labels)] = series
+		}
+		for _, series := range left {
+			if other, ok := rightByLabels[LabelsKey(series.labels)]; ok {
+				matched = append(matched, join(series, other, series.labels))
+			}
+		}
+	}
+	return matched
+}
+
+// aggregateSeries reduces points with the same timestamp of the series with the same values of the by labels
+func aggregateSeries(aggregate string, by []string, operand []expressionSeries) []expressionSeries {
+	type reduction struct {
+		sum, min, max float64
+		count         int
+	}
+	groups := make(map[string]map[uint64]*reduction)
+	labels := make(map[string]map[string]string)
+	order := make([]string, 0)
+	for _, series := range operand {
+		groupLabels := make(map[string]string)
+		for _, label := range by {
+			if value, ok := series.labels[label]; ok {
+				groupLabels[label] = value
+			}
+		}
+		key := LabelsKey(groupLabels)
+		if _, ok := groups[key]; !ok {
+			groups[key], labels[key] = make(map[uint64]*reduction), groupLabels
+			order = append(order, key)
+		}
+		for timestamp, value := range series.points {
+			if math.IsNaN(value) {
+				continue
+			}
+			current, ok := groups[key][timestamp]
+			if !ok {
+				current = &reduction{min: value, max: value}
+				groups[key][timestamp] = current
+			}
+			current.sum += value
+			current.min = math.Min(current.min, value)
+			current.max = math.Max(current.max, value)
+			current.count++
+		}
+	}
+	aggregated := make([]expressionSeries, 0, len(order))
+	for _, key := range order {
+		points := make(map[uint64]float64, len(groups[key]))
+		for timestamp, current := range groups[key] {
+			switch aggregate {
+			case "sum":
+				points[timestamp] = current.sum
+			case "avg":
+				points[timestamp] = current.sum / float64(current.count)
+			case "min":
+				points[timestamp] = current.min
+			case "max":
+				points[timestamp] = current.max
+			case "count":
+				points[timestamp] = float64(current.count)
+			}
+		}
+		aggregated = append(aggregated, expressionSeries{labels: labels[key], points: points})
+	}
+	return aggregated
+}
+
+type expressionDataSource struct {
+	dataSource DataSource
+	panels     PanelProvider
+}
+
+type streamingExpressionDataSource struct {
+	expressionDataSource
+	streamingDataSource StreamingDataSource
+}
+
+// WithExpressions returns DataSource which evaluates expressions of derived panels; selectors of the expression load
+// series of other panels from the data source (or evaluate their expressions), other panels are served by the data source as is
+func WithExpressions(dataSource DataSource, panels PanelProvider) DataSource {
+	expressions := expressionDataSource{dataSource: dataSource, panels: panels}
+	if streamingDataSource, ok := dataSource.(StreamingDataSource); ok {
+		return streamingExpressionDataSource{expressionDataSource: expressions, streamingDataSource: streamingDataSource}
+	}
+	return expressions
+}
+
+// selectSeries loads instance series of the panel and aligns their points to the resolution grid
+func (s expressionDataSource) selectSeries(ctx context.Context, selector selectorExpression, query MetricQuery) ([]expressionSeries, error) {
+	query.StartTime, query.EndTime = query.StartTime.Add(-selector.offset), query.EndTime.Add(-selector.offset)
+	selected := make([]expressionSeries, 0)
+	err := ConsumeStream(func(metrics chan<- Metric) error {
+		return s.GetMetric(ctx, selector.panelId, query, metrics)
+	}, func(metric Metric) {
+		if metric.Type != InstanceMetricLineType {
+			return
+		}
+		if query.Resolution > 0 {
+			metric = DownsampleMetric(metric, query.Resolution, AvgDownsample)
+		}
+		series := expressionSeries{labels: metric.Labels, points: make(map[uint64]float64, len(metric.Timestamps))}
+		for i, timestamp := range metric.Timestamps {
+			series.points[timestamp+uint64(selector.offset.Microseconds())] = float64(metric.Values[i])
+		}
+		selected = append(selected, series)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to select panel: id=%v, err=%w", selector.panelId, err)
+	}
+	return selected, nil
+}
+
+// evaluateVector computes series of the vector expression within the query range
+func (s expressionDataSource) evaluateVector(ctx context.Context, expression Expression, query MetricQuery) ([]expressionSeries, error) {
+	switch e := expression.(type) {
+	case selectorExpression:
+		return s.selectSeries(ctx, e, query)
+	case negationExpression:
+		operand, err := s.evaluateVector(ctx, e.operand, query)
+		if err != nil {
+			return nil, err
+		}
+		for i := range operand {
+			operand[i] = operand[i].mapValues(func(value float64) float64 { return -value })
+		}
+		return operand, nil
+	case binaryExpression:
+		if e.left.Type() == ScalarExpressionType {
+			left := evaluateScalar(e.left)
+			right, err := s.evaluateVector(ctx, e.right, query)
+			if err != nil {
+				return nil, err
+			}
+			for i := range right {
+				right[i] = right[i].mapValues(func(value float64) float64 { return applyOperator(e.operator, left, value) })
+			}
+			return right, nil
+		}
+		left, err := s.evaluateVector(ctx, e.left, query)
+		if err != nil {
+			return nil, err
+		}
+		if e.right.Type() == ScalarExpressionType {
+			right := evaluateScalar(e.right)
+			for i := range left {
+				left[i] = left[i].mapValues(func(value float64) float64 { return applyOperator(e.operator, value, right) })
+			}
+			return left, nil
+		}
+		right, err := s.evaluateVector(ctx, e.right, query)
+		if err != nil {
+			return nil, err
+		}
+		return matchSeries(e.operator, left, right), nil
+	case callExpression:
+		if counterFunctions[e.function] {
+			return s.evaluateCounter(ctx, e, query)
+		}
+		operand, err := s.evaluateVector(ctx, e.arguments[0], query)
+		if err != nil {
+			return nil, err
+		}
+		bound := 0.0
+		if len(e.arguments) > 1 {
+			bound = evaluateScalar(e.arguments[1])
+		}
+		for i := range operand {
+			operand[i] = operand[i].mapValues(func(value float64) float64 { return applyFunction(e.function, value, bound) })
+		}
+		return operand, nil
+	case aggregateExpression:
+		operand, err := s.evaluateVector(ctx, e.operand, query)
+		if err != nil {
+			return nil, err
+		}
+		return aggregateSeries(e.aggregate, e.by, operand), nil
+	}
+	return nil, fmt.Errorf("unexpected vector expression: %T", expression)
+}
+
+// evaluateCounter applies counter transform to every series of the operand which is loaded one bucket earlier
+// in order to have predecessor for the first point of the query
+func (s expressionDataSource) evaluateCounter(ctx context.Context, call callExpression, query MetricQuery) ([]expressionSeries, error) {
+	extended := query
+	extended.StartTime = query.StartTime.Add(-query.Resolution)
+	operand, err := s.evaluateVector(ctx, call.arguments[0], extended)
+	if err != nil {
+		return nil, err
+	}
+	transformed := make([]expressionSeries, 0, len(operand))
+	for _, series := range operand {
+		counter, err := NewCounterTransform(call.function)
+		if err != nil {
+			return nil, err
+		}
+		metric := counter.Apply(series.metric(""))
+		points := make(map[uint64]float64, len(metric.Timestamps))
+		for i, timestamp := range metric.Timestamps {
+			if timestamp >= uint64(query.StartTime.UnixMicro()) {
+				points[timestamp] = float64(metric.Values[i])
+			}
+		}
+		transformed = append(transformed, expressionSeries{labels: series.labels, points: points})
+	}
+	return transformed, nil
+}
+
+func (s expressionDataSource) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
+	panel, err := s.panels.GetPanel(ctx, panelId)
+	if err != nil {
+		return fmt.Errorf("failed to get panel: id=%v, err=%w", panelId, err)
+	}
+	if panel.Expression == "" {
+		return s.dataSource.GetMetric(ctx, panelId, query, metrics)
+	}
+	depth, _ := ctx.Value(expressionDepthKey{}).(int)
+	if depth >= MaxExpressionDepth {
+		return fmt.Errorf("expression nesting is too deep: id=%v, depth=%v", panelId, depth)
+	}
+	expression, err := ParseExpression(panel.Expression)
+	if err != nil {
+		return fmt.Errorf("invalid panel expression: id=%v, err=%w", panelId, err)
+	}
+	var evaluated []expressionSeries
+	if expression.Type() == ScalarExpressionType {
+		if query.Resolution <= 0 {
+			return fmt.Errorf("scalar expression requires resolution: id=%v", panelId)
+		}
+		// scalar is drawn as a constant line on the resolution grid
+		constant := expressionSeries{labels: map[string]string{}, points: make(map[uint64]float64)}
+		step := uint64(query.Resolution.Microseconds())
+		start, end := uint64(query.StartTime.UnixMicro()), uint64(query.EndTime.UnixMicro())
+		for timestamp := start + (step-start%step)%step; timestamp <= end; timestamp += step {
+			constant.points[timestamp] = evaluateScalar(expression)
+		}
+		evaluated = []expressionSeries{constant}
+	} else if evaluated, err = s.evaluateVector(context.WithValue(ctx, expressionDepthKey{}, depth+1), expression, query); err != nil {
+		return fmt.Errorf("failed to evaluate panel expression: id=%v, err=%w", panelId, err)
+	}
+	sort.Slice(evaluated, func(i, j int) bool { return LabelsKey(evaluated[i].labels) < LabelsKey(evaluated[j].labels) })
+	for _, series := range evaluated {
+		if len(series.points) == 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case metrics <- series.metric(panelId):
+		}
+	}
+	return nil
+}
+
+// Subscribe streams panels without expressions; expression panels are polled since their selectors may be served by different queries
+func (s streamingExpressionDataSource) Subscribe(ctx context.Context, panelId string, from time.Time, resolution time.Duration, metrics chan<- Metric) error {
+	panel, err := s.panels.GetPanel(ctx, panelId)
+	if err != nil {
+		return fmt.Errorf("failed to get panel: id=%v, err=%w", panelId, err)
+	}
+	if panel.Expression != "" {
+		return ErrStreamingNotSupported
+	}
+	return s.streamingDataSource.Subscribe(ctx, panelId, from, resolution, metrics)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type panelDataSource map[string][]Metric
+
+func (s panelDataSource) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
+	for _, metric := range s[panelId] {
+		metrics <- metric
+	}
+	return nil
+}
+
+func evaluateExpression(t *testing.T, dataSource DataSource, expression string, query MetricQuery) []Metric {
+	panels := staticPanels{"e": Panel{Id: "e", Expression: expression}}
+	for panelId := range dataSource.(panelDataSource) {
+		panels[panelId] = Panel{Id: panelId}
+	}
+	metrics := make(chan Metric, 16)
+	require.Nil(t, WithExpressions(dataSource, panels).GetMetric(context.Background(), "e", query, metrics))
+	close(metrics)
+	evaluated := make([]Metric, 0)
+	for metric := range metrics {
+		require.Equal(t, "e", metric.PanelId)
+		evaluated = append(evaluated, metric)
+	}
+	return evaluated
+}
+
+func TestExpressionDataSource(t *testing.T) {
+	dataSource := panelDataSource{
+		"errors": {
+			{Type: InstanceMetricLineType, Labels: map[string]string{"host": "a", "code": "500"}, Timestamps: []uint64{0, 1000, 2000}, Values: []float32{1, 2, 3}},
+			{Type: InstanceMetricLineType, Labels: map[string]string{"host": "b", "code": "500"}, Timestamps: []uint64{0, 1000, 2000}, Values: []float32{3, 2, 1}},
+			{Type: GroupMeanMetricLineType, Timestamps: []uint64{0}, Values: []float32{100}},
+		},
+		"requests": {
+			{Type: InstanceMetricLineType, Labels: map[string]string{"host": "a"}, Timestamps: []uint64{0, 400, 1000}, Values: []float32{5, 15, 20}},
+			{Type: InstanceMetricLineType, Labels: map[string]string{"host": "b"}, Timestamps: []uint64{0, 1000, 2000}, Values: []float32{10, 10, 10}},
+		},
+	}
+	query := MetricQuery{StartTime: time.UnixMicro(0), EndTime: time.UnixMicro(2000), Resolution: time.Millisecond}
+
+	t.Run("aggregate", func(t *testing.T) {
+		evaluated := evaluateExpression(t, dataSource, "sum by (code) (errors)", query)
+		require.Len(t, evaluated, 1)
+		require.Equal(t, map[string]string{"code": "500"}, evaluated[0].Labels)
+		require.Equal(t, []float32{4, 4, 4}, evaluated[0].Values)
+	})
+
+	t.Run("vector matching", func(t *testing.T) {
+		// crowded bucket of requests is averaged, timestamp missing in one of the operands is skipped
+		evaluated := evaluateExpression(t, dataSource, "sum by (host) (errors) / requests * 100", query)
+		require.Len(t, evaluated, 2)
+		require.Equal(t, map[string]string{"host": "a"}, evaluated[0].Labels)
+		require.Equal(t, []uint64{0, 1000}, evaluated[0].Timestamps)
+		require.Equal(t, []float32{10, 10}, evaluated[0].Values)
+		require.Equal(t, []float32{30, 20, 10}, evaluated[1].Values)
+
+		evaluated = evaluateExpression(t, dataSource, "errors - sum(errors)", query)
+		require.Len(t, evaluated, 2)
+		require.Equal(t, []float32{-3, -2, -1}, evaluated[0].Values)
+	})
+
+	t.Run("functions", func(t *testing.T) {
+		evaluated := evaluateExpression(t, dataSource, `clamp_min(rate(requests), 5000) - max(requests offset 1ms)`, query)
+		require.Len(t, evaluated, 2)
+		require.Equal(t, []uint64{1000}, evaluated[0].Timestamps)
+		require.Equal(t, []float32{9990}, evaluated[0].Values)
+		require.Equal(t, []uint64{1000, 2000}, evaluated[1].Timestamps)
+		require.Equal(t, []float32{4990, 4980}, evaluated[1].Values)
+	})
+
+	t.Run("scalar", func(t *testing.T) {
+		evaluated := evaluateExpression(t, dataSource, "2 * 3", MetricQuery{StartTime: time.UnixMicro(500), EndTime: time.UnixMicro(3000), Resolution: time.Millisecond})
+		require.Len(t, evaluated, 1)
+		require.Equal(t, []uint64{1000, 2000, 3000}, evaluated[0].Timestamps)
+		require.Equal(t, []float32{6, 6, 6}, evaluated[0].Values)
+	})
+
+	t.Run("cycles and streaming", func(t *testing.T) {
+		panels := staticPanels{"a": Panel{Id: "a", Expression: "b + 1"}, "b": Panel{Id: "b", Expression: "a"}}
+		metrics := make(chan Metric, 16)
+		require.NotNil(t, WithExpressions(dataSource, panels).GetMetric(context.Background(), "a", query, metrics))
+
+		_, streaming := WithExpressions(NewMemoryStorage(0), panels).(StreamingDataSource)
+		require.True(t, streaming)
+		err := WithExpressions(NewMemoryStorage(0), panels).(StreamingDataSource).Subscribe(context.Background(), "a", time.Now(), time.Second, metrics)
+		require.ErrorIs(t, err, ErrStreamingNotSupported)
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExpression(t *testing.T) {
+	expression, err := ParseExpression(`sum by (code) (rate(errors)) / sum(rate("http-requests" offset 1d)) * 100`)
+	require.Nil(t, err)
+	require.Equal(t, VectorExpressionType, expression.Type())
+	product := expression.(binaryExpression)
+	require.Equal(t, byte('*'), product.operator)
+	require.Equal(t, numberExpression{value: 100}, product.right)
+	ratio := product.left.(binaryExpression)
+	require.Equal(t, []string{"code"}, ratio.left.(aggregateExpression).by)
+	selector := ratio.right.(aggregateExpression).operand.(callExpression).arguments[0]
+	require.Equal(t, selectorExpression{panelId: "http-requests", offset: 24 * time.Hour}, selector)
+
+	expression, err = ParseExpression("-clamp_max(2 * 3, 5) + abs(-1)")
+	require.Nil(t, err)
+	require.Equal(t, ScalarExpressionType, expression.Type())
+	require.Equal(t, -4.0, evaluateScalar(expression))
+
+	for _, invalid := range []string{
+		"",
+		"1 +",
+		"(errors",
+		"errors requests",
+		"rate(1)",
+		"sum(2)",
+		"clamp_min(errors, requests)",
+		"abs(errors, 1)",
+		"median(errors)",
+		"errors offset 1x",
+		"sum by () (errors)",
+		`"unterminated`,
+		"errors % 2",
+	} {
+		_, err := ParseExpression(invalid)
+		require.NotNil(t, err, invalid)
+	}
+}
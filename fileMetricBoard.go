@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type dashboardFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+type FileMetricBoard struct {
+	DataSource
+
+	dir        string
+	lock       sync.RWMutex
+	files      []dashboardFile
+	dashboards map[string]Dashboard
+	panels     map[string]Panel
+}
+
+func NewFileMetricBoard(dir string, dataSource DataSource) (*FileMetricBoard, error) {
+	board := &FileMetricBoard{DataSource: dataSource, dir: dir}
+	if err := board.Reload(); err != nil {
+		return nil, err
+	}
+	return board, nil
+}
+
+func (b *FileMetricBoard) GetDashboard(ctx context.Context, dashboardId string) (Dashboard, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	dashboard, ok := b.dashboards[dashboardId]
+	if !ok {
+		return Dashboard{}, fmt.Errorf("dashboard not found: id=%v", dashboardId)
+	}
+	return dashboard, nil
+}
+
+func (b *FileMetricBoard) GetPanel(ctx context.Context, panelId string) (Panel, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	panel, ok := b.panels[panelId]
+	if !ok {
+		return Panel{}, fmt.Errorf("panel not found: id=%v", panelId)
+	}
+	return panel, nil
+}
+
+// ListPanels returns panels of all loaded dashboards ordered by id
+func (b *FileMetricBoard) ListPanels(ctx context.Context) ([]Panel, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	panels := make([]Panel, 0, len(b.panels))
+	for _, panel := range b.panels {
+		panels = append(panels, panel)
+	}
+	sort.Slice(panels, func(i, j int) bool { return panels[i].Id < panels[j].Id })
+	return panels, nil
+}
+
+// Reload reads all dashboard definitions from the directory and atomically replaces current state.
+// If any of the files is invalid, the error is returned and previous state is kept untouched
+func (b *FileMetricBoard) Reload() error {
+	files, err := listDashboardFiles(b.dir)
+	if err != nil {
+		return err
+	}
+	dashboards := make(map[string]Dashboard)
+	panels := make(map[string]Panel)
+	for _, file := range files {
+		dashboard, err := loadDashboard(file.path)
+		if err != nil {
+			return err
+		}
+		if _, ok := dashboards[dashboard.Id]; ok {
+			return fmt.Errorf("duplicate dashboard id: id=%v, path=%v", dashboard.Id, file.path)
+		}
+		dashboards[dashboard.Id] = dashboard
+		for _, row := range dashboard.Rows {
+			for _, panel := range row.Panels {
+				if _, ok := panels[panel.Id]; ok {
+					return fmt.Errorf("duplicate panel id: id=%v, path=%v", panel.Id, file.path)
+				}
+				panels[panel.Id] = panel
+			}
+		}
+	}
+	b.lock.Lock()
+	b.files = files
+	b.dashboards = dashboards
+	b.panels = panels
+	b.lock.Unlock()
+	Logger.Infof("loaded dashboards: dir=%v, dashboards=%v, panels=%v", b.dir, len(dashboards), len(panels))
+	return nil
+}
+
+// Watch polls the directory every interval and reloads dashboards when any of the files was added, removed or modified
+func (b *FileMetricBoard) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			files, err := listDashboardFiles(b.dir)
+			if err != nil {
+				Logger.Errorf("failed to list dashboards: dir=%v, err=%v", b.dir, err)
+				continue
+			}
+			b.lock.RLock()
+			changed := !sameDashboardFiles(b.files, files)
+			b.lock.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := b.Reload(); err != nil {
+				Logger.Errorf("failed to reload dashboards, keep previous version: dir=%v, err=%v", b.dir, err)
+				b.lock.Lock()
+				b.files = files
+				b.lock.Unlock()
+			}
+		}
+	}
+}
+
+func isDashboardFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+func listDashboardFiles(dir string) ([]dashboardFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dashboards dir: dir=%v, err=%w", dir, err)
+	}
+	files := make([]dashboardFile, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !isDashboardFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat dashboard file: name=%v, err=%w", entry.Name(), err)
+		}
+		files = append(files, dashboardFile{path: filepath.Join(dir, entry.Name()), modTime: info.ModTime(), size: info.Size()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	return files, nil
+}
+
+func sameDashboardFiles(a, b []dashboardFile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].path != b[i].path || !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
+
+func loadDashboard(path string) (Dashboard, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return Dashboard{}, fmt.Errorf("failed to read dashboard file: path=%v, err=%w", path, err)
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		// convert yaml to json in order to reuse json tags of the dashboard structures
+		var document any
+		if err = yaml.Unmarshal(content, &document); err != nil {
+			return Dashboard{}, fmt.Errorf("failed to parse yaml dashboard: path=%v, err=%w", path, err)
+		}
+		if content, err = json.Marshal(document); err != nil {
+			return Dashboard{}, fmt.Errorf("failed to convert yaml dashboard: path=%v, err=%w", path, err)
+		}
+	}
+	var dashboard Dashboard
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&dashboard); err != nil {
+		return Dashboard{}, fmt.Errorf("failed to parse dashboard: path=%v, err=%w", path, err)
+	}
+	if dashboard.Id == "" {
+		dashboard.Id = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if err = ValidateDashboard(dashboard); err != nil {
+		return Dashboard{}, fmt.Errorf("invalid dashboard: path=%v, err=%w", path, err)
+	}
+	return dashboard, nil
+}
+
+func ValidateDashboard(dashboard Dashboard) error {
+	if dashboard.Id == "" {
+		return fmt.Errorf("empty dashboard id")
+	}
+	if err := ValidateVariables(dashboard.Variables); err != nil {
+		return fmt.Errorf("invalid dashboard variables: %w", err)
+	}
+	panelIds := make(map[string]struct{})
+	for i, row := range dashboard.Rows {
+		if len(row.Panels) == 0 {
+			return fmt.Errorf("row without panels: row=%v", i)
+		}
+		if len(row.Widths) != 0 && len(row.Widths) != len(row.Panels) {
+			return fmt.Errorf("widths must be set for every panel: row=%v, widths=%v, panels=%v", i, len(row.Widths), len(row.Panels))
+		}
+		if len(row.Heights) > 1 && len(row.Heights) != len(row.Panels) {
+			return fmt.Errorf("heights must be set either for whole row or for every panel: row=%v, heights=%v, panels=%v", i, len(row.Heights), len(row.Panels))
+		}
+		for _, size := range append(append([]int{}, row.Widths...), row.Heights...) {
+			if size <= 0 {
+				return fmt.Errorf("non-positive panel size: row=%v, size=%v", i, size)
+			}
+		}
+		for _, panel := range row.Panels {
+			if panel.Id == "" {
+				return fmt.Errorf("empty panel id: row=%v", i)
+			}
+			if _, ok := panelIds[panel.Id]; ok {
+				return fmt.Errorf("duplicate panel id: row=%v, id=%v", i, panel.Id)
+			}
+			panelIds[panel.Id] = struct{}{}
+			if err := ValidatePanelTransforms(panel); err != nil {
+				return fmt.Errorf("invalid panel transforms: row=%v, id=%v, err=%w", i, panel.Id, err)
+			}
+			if panel.Expression != "" {
+				if _, err := ParseExpression(panel.Expression); err != nil {
+					return fmt.Errorf("invalid panel expression: row=%v, id=%v, err=%w", i, panel.Id, err)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileMetricBoard(t *testing.T) {
+	t.Run("json and yaml", func(t *testing.T) {
+		dir := t.TempDir()
+		require.Nil(t, os.WriteFile(filepath.Join(dir, "a.json"), []byte(`{"title": "a", "rows": [{"widths": [24], "panels": [{"id": "p-1", "units": "ms"}]}]}`), 0o644))
+		require.Nil(t, os.WriteFile(filepath.Join(dir, "b.yaml"), []byte("id: dashboard-b\nrows:\n  - panels:\n      - id: p-2\n        name: second\n"), 0o644))
+		require.Nil(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("ignored"), 0o644))
+
+		board, err := NewFileMetricBoard(dir, MockMetricBoard{})
+		require.Nil(t, err)
+
+		a, err := board.GetDashboard(context.Background(), "a")
+		require.Nil(t, err)
+		require.Equal(t, []string{"p-1"}, a.Panels())
+		b, err := board.GetDashboard(context.Background(), "dashboard-b")
+		require.Nil(t, err)
+		require.Equal(t, []string{"p-2"}, b.Panels())
+		panel, err := board.GetPanel(context.Background(), "p-2")
+		require.Nil(t, err)
+		require.Equal(t, "second", panel.Name)
+		_, err = board.GetPanel(context.Background(), "p-3")
+		require.NotNil(t, err)
+		panels, err := board.ListPanels(context.Background())
+		require.Nil(t, err)
+		require.Len(t, panels, 2)
+		require.Equal(t, "p-1", panels[0].Id)
+	})
+	t.Run("invalid reload keeps previous state", func(t *testing.T) {
+		dir := t.TempDir()
+		require.Nil(t, os.WriteFile(filepath.Join(dir, "a.json"), []byte(`{"rows": [{"panels": [{"id": "p-1"}]}]}`), 0o644))
+		board, err := NewFileMetricBoard(dir, MockMetricBoard{})
+		require.Nil(t, err)
+
+		require.Nil(t, os.WriteFile(filepath.Join(dir, "b.json"), []byte(`{"rows": [{"panels": [{"id": "p-1"}]}]}`), 0o644))
+		require.NotNil(t, board.Reload())
+		_, err = board.GetDashboard(context.Background(), "a")
+		require.Nil(t, err)
+		_, err = board.GetDashboard(context.Background(), "b")
+		require.NotNil(t, err)
+	})
+	t.Run("watch reloads changed files", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		dir := t.TempDir()
+		path := filepath.Join(dir, "a.json")
+		require.Nil(t, os.WriteFile(path, []byte(`{"rows": [{"panels": [{"id": "p-1", "name": "first"}]}]}`), 0o644))
+		board, err := NewFileMetricBoard(dir, MockMetricBoard{})
+		require.Nil(t, err)
+		go board.Watch(ctx, time.Millisecond)
+
+		panelName := func(panelId string) string {
+			panel, err := board.GetPanel(context.Background(), panelId)
+			if err != nil {
+				return ""
+			}
+			return panel.Name
+		}
+		// edit of the same size is detected by modification time, which is moved explicitly since its granularity can be coarse
+		info, err := os.Stat(path)
+		require.Nil(t, err)
+		require.Nil(t, os.WriteFile(path, []byte(`{"rows": [{"panels": [{"id": "p-1", "name": "other"}]}]}`), 0o644))
+		require.Nil(t, os.Chtimes(path, info.ModTime().Add(time.Second), info.ModTime().Add(time.Second)))
+		require.Eventually(t, func() bool { return panelName("p-1") == "other" }, 5*time.Second, time.Millisecond)
+
+		require.Nil(t, os.WriteFile(filepath.Join(dir, "b.json"), []byte(`{"rows": [{"panels": [{"id": "p-2", "name": "second"}]}]}`), 0o644))
+		require.Eventually(t, func() bool { return panelName("p-2") == "second" }, 5*time.Second, time.Millisecond)
+	})
+	t.Run("validation", func(t *testing.T) {
+		require.NotNil(t, ValidateDashboard(Dashboard{}))
+		require.NotNil(t, ValidateDashboard(Dashboard{Id: "d", Rows: []Row{{Widths: []int{12}, Panels: []Panel{{Id: "a"}, {Id: "b"}}}}}))
+		require.NotNil(t, ValidateDashboard(Dashboard{Id: "d", Rows: []Row{{Panels: []Panel{{Id: ""}}}}}))
+		require.Nil(t, ValidateDashboard(Dashboard{Id: "d", Rows: []Row{{Heights: []int{8}, Widths: []int{12, 12}, Panels: []Panel{{Id: "a"}, {Id: "b"}}}}}))
+	})
+}
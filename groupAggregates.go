@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+)
+
+// GroupAggregates aligns instance metrics of every non-empty group by timestamp and computes mean and variance lines for them.
+// Timestamps missing in some group members (and NaN values) are ignored for these members
+func GroupAggregates(metrics []Metric) []Metric {
+	groups := make(map[string][]Metric)
+	order := make([]string, 0)
+	for _, metric := range metrics {
+		if metric.Type != InstanceMetricLineType || metric.Group == "" {
+			continue
+		}
+		if _, ok := groups[metric.Group]; !ok {
+			order = append(order, metric.Group)
+		}
+		groups[metric.Group] = append(groups[metric.Group], metric)
+	}
+	aggregates := make([]Metric, 0, 2*len(order))
+	for _, group := range order {
+		type moments struct {
+			sum, sumSquares float64
+			count           int
+		}
+		points := make(map[uint64]*moments)
+		for _, metric := range groups[group] {
+			for i, timestamp := range metric.Timestamps {
+				value := float64(metric.Values[i])
+				if math.IsNaN(value) {
+					continue
+				}
+				point, ok := points[timestamp]
+				if !ok {
+					point = &moments{}
+					points[timestamp] = point
+				}
+				point.sum += value
+				point.sumSquares += value * value
+				point.count++
+			}
+		}
+		timestamps := make([]uint64, 0, len(points))
+		for timestamp := range points {
+			timestamps = append(timestamps, timestamp)
+		}
+		sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+		mean := Metric{PanelId: groups[group][0].PanelId, Type: GroupMeanMetricLineType, Group: group, Timestamps: timestamps, Values: make([]float32, len(timestamps))}
+		variance := Metric{PanelId: groups[group][0].PanelId, Type: GroupVarianceMetricLineType, Group: group, Timestamps: timestamps, Values: make([]float32, len(timestamps))}
+		for i, timestamp := range timestamps {
+			point := points[timestamp]
+			average := point.sum / float64(point.count)
+			mean.Values[i] = float32(average)
+			variance.Values[i] = float32(math.Max(0, point.sumSquares/float64(point.count)-average*average))
+		}
+		aggregates = append(aggregates, mean, variance)
+	}
+	return aggregates
+}
+
+type groupAggregatingDataSource struct {
+	dataSource DataSource
+}
+
+type streamingGroupAggregatingDataSource struct {
+	groupAggregatingDataSource
+	streamingDataSource StreamingDataSource
+}
+
+// WithGroupAggregates returns DataSource which additionally emits group mean and variance lines for all grouped instance metrics
+func WithGroupAggregates(dataSource DataSource) DataSource {
+	aggregating := groupAggregatingDataSource{dataSource: dataSource}
+	if streamingDataSource, ok := dataSource.(StreamingDataSource); ok {
+		return streamingGroupAggregatingDataSource{groupAggregatingDataSource: aggregating, streamingDataSource: streamingDataSource}
+	}
+	return aggregating
+}
+
+// metricBetween returns points of the metric with timestamps within [start, end]
+func metricBetween(metric Metric, start, end uint64) Metric {
+	from := sort.Search(len(metric.Timestamps), func(i int) bool { return metric.Timestamps[i] >= start })
+	to := sort.Search(len(metric.Timestamps), func(i int) bool { return metric.Timestamps[i] > end })
+	metric.Timestamps, metric.Values = metric.Timestamps[from:to], metric.Values[from:to]
+	return metric
+}
+
+func (s groupAggregatingDataSource) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
+	grouped := make([]Metric, 0)
+	err := ConsumeStream(func(inner chan<- Metric) error {
+		return s.dataSource.GetMetric(ctx, panelId, query, inner)
+	}, func(metric Metric) {
+		if metric.Type == InstanceMetricLineType && metric.Group != "" {
+			grouped = append(grouped, metric)
+		}
+		select {
+		case <-ctx.Done():
+		case metrics <- metric:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, aggregate := range GroupAggregates(grouped) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case metrics <- aggregate:
+		}
+	}
+	return nil
+}
+
+// Subscribe recomputes group lines for the buckets of every pushed grouped metric from the latest pushed points of all group members
+func (s streamingGroupAggregatingDataSource) Subscribe(ctx context.Context, panelId string, from time.Time, resolution time.Duration, metrics chan<- Metric) error {
+	latest := make(map[string]Metric)
+	return ConsumeStream(func(inner chan<- Metric) error {
+		return s.streamingDataSource.Subscribe(ctx, panelId, from, resolution, inner)
+	}, func(metric Metric) {
+		select {
+		case <-ctx.Done():
+			return
+		case metrics <- metric:
+		}
+		if metric.Type != InstanceMetricLineType || metric.Group == "" || len(metric.Timestamps) == 0 {
+			return
+		}
+		latest[metric.Key()] = metric
+		start, end := metric.Timestamps[0], metric.Timestamps[len(metric.Timestamps)-1]
+		members := make([]Metric, 0)
+		for _, member := range latest {
+			if member.Group == metric.Group {
+				members = append(members, metricBetween(member, start, end))
+			}
+		}
+		for _, aggregate := range GroupAggregates(members) {
+			select {
+			case <-ctx.Done():
+				return
+			case metrics <- aggregate:
+			}
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupAggregates(t *testing.T) {
+	aggregates := GroupAggregates([]Metric{
+		{PanelId: "p", Type: InstanceMetricLineType, Group: "g", Timestamps: []uint64{1, 2, 3}, Values: []float32{1, 2, 3}},
+		{PanelId: "p", Type: InstanceMetricLineType, Group: "g", Timestamps: []uint64{2, 3, 4}, Values: []float32{4, float32(math.NaN()), 8}},
+		{PanelId: "p", Type: InstanceMetricLineType, Timestamps: []uint64{1}, Values: []float32{100}},
+	})
+	require.Len(t, aggregates, 2)
+	require.Equal(t, GroupMeanMetricLineType, aggregates[0].Type)
+	require.Equal(t, []uint64{1, 2, 3, 4}, aggregates[0].Timestamps)
+	require.Equal(t, []float32{1, 3, 3, 8}, aggregates[0].Values)
+	require.Equal(t, GroupVarianceMetricLineType, aggregates[1].Type)
+	require.Equal(t, []float32{0, 1, 0, 0}, aggregates[1].Values)
+
+	metrics := make(chan Metric, 4)
+	dataSource := WithGroupAggregates(staticDataSource{
+		{Type: InstanceMetricLineType, Group: "g", Timestamps: []uint64{1}, Values: []float32{1}},
+		{Type: InstanceMetricLineType, Group: "g", Timestamps: []uint64{1}, Values: []float32{3}},
+	})
+	require.Nil(t, dataSource.GetMetric(context.Background(), "p", MetricQuery{}, metrics))
+	require.Len(t, metrics, 4)
+}
+
+func TestStreamingGroupAggregates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pushes := make(chan Metric, 2)
+	pushes <- Metric{Type: InstanceMetricLineType, Group: "g", Labels: map[string]string{"host": "a"}, Timestamps: []uint64{1, 2}, Values: []float32{1, 2}}
+	pushes <- Metric{Type: InstanceMetricLineType, Group: "g", Labels: map[string]string{"host": "b"}, Timestamps: []uint64{2}, Values: []float32{4}}
+	dataSource, ok := WithGroupAggregates(pushingDataSource{pushes: pushes}).(StreamingDataSource)
+	require.True(t, ok)
+	metrics := make(chan Metric)
+	go func() { _ = dataSource.Subscribe(ctx, "p", time.Time{}, time.Second, metrics) }()
+
+	received := make([]Metric, 0)
+	for len(received) < 6 {
+		received = append(received, <-metrics)
+	}
+	require.Equal(t, GroupMeanMetricLineType, received[1].Type)
+	require.Equal(t, []float32{1, 2}, received[1].Values)
+	// group lines of the pushed bucket are recomputed with the latest points of other group members
+	require.Equal(t, GroupMeanMetricLineType, received[4].Type)
+	require.Equal(t, []uint64{2}, received[4].Timestamps)
+	require.Equal(t, []float32{3}, received[4].Values)
+	require.Equal(t, []float32{1}, received[5].Values)
+}
+
+type staticDataSource []Metric
+
+func (s staticDataSource) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
+	for _, metric := range s {
+		metrics <- metric
+	}
+	return nil
+}
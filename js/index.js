@@ -1,62 +1,223 @@
-let getUint64 = function(dataView) {
-  const low = dataView.getUint32(0, true);
-  const high = dataView.getUint32(4, true);
+let getUint64 = function(dataView, offset) {
+  const low = dataView.getUint32(offset, true);
+  const high = dataView.getUint32(offset + 4, true);
   return low + high * 4294967296;
 };
+let getUvarint = function(dataView, offset) {
+  let result = 0, scale = 1, byte;
+  do {
+    byte = dataView.getUint8(offset++);
+    result += (byte & 127) * scale;
+    scale *= 128;
+  } while (byte & 128);
+  return [result, offset];
+};
+let getVarint = function(dataView, offset) {
+  const [zigzag, next] = getUvarint(dataView, offset);
+  return [zigzag % 2 == 1 ? -(zigzag + 1) / 2 : zigzag / 2, next];
+};
+let decodeColumn = function(dataView, offset) {
+  const version = dataView.getUint8(offset);
+  const length = dataView.getUint32(offset + 1, true);
+  const values = [];
+  offset += 5;
+  switch (version) {
+    case F32Bin:
+      for (let i = 0;i < length; i++) {
+        values.push(dataView.getFloat32(offset + 4 * i, true));
+      }
+      return [values, offset + 4 * length];
+    case U64Bin:
+      for (let i = 0;i < length; i++) {
+        values.push(getUint64(dataView, offset + 8 * i));
+      }
+      return [values, offset + 8 * length];
+    case U64DeltaBin: {
+      let previous = 0, delta = 0, value;
+      for (let i = 0;i < length; i++) {
+        if (i == 0) {
+          [previous, offset] = getUvarint(dataView, offset);
+        } else {
+          [value, offset] = getVarint(dataView, offset);
+          delta = i == 1 ? value : delta + value;
+          previous += delta;
+        }
+        values.push(previous);
+      }
+      return [values, offset];
+    }
+    case F32XorBin: {
+      let position = offset * 8;
+      const read = (n) => {
+        let result = 0;
+        for (let i = 0;i < n; i++, position++) {
+          result = result * 2 + (dataView.getUint8(position >> 3) >> 7 - position % 8 & 1);
+        }
+        return result;
+      };
+      const bits = new DataView(new ArrayBuffer(4));
+      let previous = 0, leading = 0, trailing = 0;
+      for (let i = 0;i < length; i++) {
+        if (i == 0) {
+          previous = read(32);
+        } else if (read(1) == 1) {
+          if (read(1) == 1) {
+            leading = read(5);
+            trailing = 32 - leading - read(5) - 1;
+          }
+          previous = (previous ^ read(32 - leading - trailing) << trailing) >>> 0;
+        }
+        bits.setUint32(0, previous);
+        values.push(bits.getFloat32(0));
+      }
+      return [values, Math.ceil(position / 8)];
+    }
+  }
+  throw new Error(`unexpected column version: ${version}`);
+};
+let decodeMetricFrame = function(buffer) {
+  const dataView = new DataView(buffer);
+  const version = dataView.getUint8(0);
+  if (version != MetricFrameBin) {
+    throw new Error(`unexpected frame version: ${version}`);
+  }
+  const headerLength = dataView.getUint32(1, true);
+  const update = JSON.parse(new TextDecoder().decode(new Uint8Array(buffer, 5, headerLength)));
+  const [timestamps, valuesOffset] = decodeColumn(dataView, 5 + headerLength);
+  const [values] = decodeColumn(dataView, valuesOffset);
+  return { update, timestamps, values };
+};
 const F32Bin = 1;
 const U64Bin = 2;
-var newPanel = function(host, panelId) {
-  const metricboard = new WebSocket(`ws://${host}/panel?id=${panelId}`);
+const MetricFrameBin = 3;
+const U64DeltaBin = 4;
+const F32XorBin = 5;
+const SupportedEncodings = ["u64-delta", "f32-xor"];
+let lowerBound = function(values, value) {
+  let left = 0, right = values.length;
+  while (left < right) {
+    const middle = left + right >> 1;
+    if (values[middle] < value) {
+      left = middle + 1;
+    } else {
+      right = middle;
+    }
+  }
+  return left;
+};
+let mergeSeries = function(series, frame) {
+  const left = lowerBound(series.timestamps, frame.update.from);
+  const right = lowerBound(series.timestamps, frame.update.to + 1);
+  series.timestamps = series.timestamps.slice(0, left).concat(frame.timestamps, series.timestamps.slice(right));
+  series.values = series.values.slice(0, left).concat(frame.values, series.values.slice(right));
+};
+let connect = function(url, name) {
+  const metricboard = new WebSocket(url);
+  metricboard.binaryType = "arraybuffer";
+  const panels = new Map;
   metricboard.addEventListener("open", (event) => {
-    console.log(`metricboard for ${panelId} opened`);
+    console.log(`metricboard for ${name} opened`);
   });
   metricboard.addEventListener("close", (event) => {
-    console.log(`metricboard for ${panelId} closed`);
+    console.log(`metricboard for ${name} closed`);
   });
   metricboard.addEventListener("message", (event) => {
-    if (event.data instanceof Blob) {
-      event.data.arrayBuffer().then((buffer) => {
-        const version = new DataView(buffer.slice(0, 1)).getUint8(0);
-        let length, values;
-        switch (version) {
-          case F32Bin:
-            length = new DataView(buffer.slice(1, 5)).getUint32(0, true);
-            values = [];
-            for (let i = 0;i < length; i++) {
-              const value = new DataView(buffer.slice(5 + 4 * i, 5 + 4 * (i + 1))).getFloat32(0, true);
-              values.push(value);
-            }
-            break;
-          case U64Bin:
-            length = new DataView(buffer.slice(1, 5)).getUint32(0, true);
-            values = [];
-            for (let i = 0;i < length; i++) {
-              const value = getUint64(new DataView(buffer.slice(5 + 8 * i, 5 + 8 * (i + 1))));
-              values.push(value);
-            }
-        }
-        console.info(length, values);
-      });
+    if (event.data instanceof ArrayBuffer) {
+      const frame = decodeMetricFrame(event.data);
+      const panel = panels.get(frame.update.id);
+      if (panel == null) {
+        return;
+      }
+      let series = panel.series.get(frame.update.key);
+      if (series == null) {
+        series = { key: frame.update.key, type: frame.update.type, group: frame.update.group, labels: frame.update.labels, timestamps: [], values: [] };
+        panel.series.set(frame.update.key, series);
+      }
+      mergeSeries(series, frame);
+      return;
+    }
+    const message = JSON.parse(event.data);
+    if (message.panel != null && message.panel.mode == "reset") {
+      panels.get(message.panel.id)?.series.clear();
+    } else if (message.trim != null) {
+      const trim = message.trim;
+      const series = panels.get(trim.panel)?.series.get(trim.key);
+      if (series != null) {
+        const count = lowerBound(series.timestamps, trim.before);
+        series.timestamps = series.timestamps.slice(count);
+        series.values = series.values.slice(count);
+      }
+    } else if (message.panel == null && message.complete == null && message.cancelled == null) {
+      panels.set(message.id, { name: message.name, description: message.description, series: new Map });
+    } else {
+      console.info(message);
     }
   });
-  return {
+  let lastRequestId = 0;
+  let maxPoints = undefined;
+  const send = (command) => {
+    const id = `${++lastRequestId}`;
+    metricboard.send(JSON.stringify({ id, ...command }));
+    return id;
+  };
+  return [{
     getPanel(id) {
-      return null;
+      const panel = panels.get(id);
+      if (panel == null) {
+        return null;
+      }
+      return { name: panel.name, description: panel.description, series: [...panel.series.values()] };
     },
     resetPanels(ids) {
-      metricboard.send(JSON.stringify({ panels: { reset: ids } }));
+      return send({ panels: { reset: ids } });
     },
-    setActivePanels(ids) {
-      metricboard.send(JSON.stringify({ panels: { active: ids } }));
+    setActivePanels(ids, visible, filters) {
+      return send({ panels: { active: ids, visible, filters } });
     },
     setConcurrency(concurrency) {
-      metricboard.send(JSON.stringify({ concurrency }));
+      return send({ concurrency });
     },
     setRefresh(refresh) {
-      metricboard.send(JSON.stringify({ refresh }));
+      return send({ refresh });
+    },
+    setRange(start, end, resolution, volatile) {
+      return send({ time: { start, end, resolution, maxPoints, volatile } });
+    },
+    setRelativeRange(from, to, resolution, timezone) {
+      return send({ time: { from, to, resolution, maxPoints, timezone } });
+    },
+    setWindow(window, resolution, volatile) {
+      return send({ time: { window, resolution, maxPoints, volatile } });
+    },
+    setMaxPoints(points) {
+      maxPoints = points;
     },
-    setRange(start, end, resolution) {
-      metricboard.send(JSON.stringify({ time: { start, end, resolution } }));
+    setVariables(values) {
+      return send({ variables: values });
+    }
+  }, panels, send];
+};
+var newPanel = function(host, panelId) {
+  const [board] = connect(`ws://${host}/panel?id=${panelId}&encodings=${SupportedEncodings.join(",")}`, panelId);
+  return board;
+};
+var newExplore = function(host) {
+  const [board, panels, send] = connect(`ws://${host}/explore?encodings=${SupportedEncodings.join(",")}`, "explore");
+  return {
+    ...board,
+    explore(explorePanels) {
+      const ids = new Set(explorePanels.map((panel) => panel.id));
+      for (const id of [...panels.keys()]) {
+        if (!ids.has(id)) {
+          panels.delete(id);
+        }
+      }
+      for (const panel of explorePanels) {
+        if (!panels.has(panel.id)) {
+          panels.set(panel.id, { name: panel.name ?? panel.id, description: "", series: new Map });
+        }
+      }
+      return send({ explore: { panels: explorePanels } });
     }
   };
 };
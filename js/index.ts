@@ -1,85 +1,358 @@
+interface Series {
+    key: string
+    type: string
+    group?: string
+    labels?: { [key: string]: string }
+    timestamps: number[]
+    values: number[]
+}
+
 interface Panel {
     name: string
     description: string
-    timestamps: number[]
-    values: number[]
+    series: Series[]
+}
+
+interface LabelMatcher {
+    label: string
+    // =, !=, =~ or !~ (regex is anchored)
+    op?: string
+    value: string
 }
 
+// series of the panel are filtered by the server; topk keeps series with the largest reduced value
+interface PanelFilter {
+    matchers?: LabelMatcher[]
+    topk?: number
+    // avg, min, max (default), last or sum
+    reducer?: string
+}
+
+// all commands return request id which is echoed in every update caused by the command
 interface MetricBoard {
     getPanel(id: string): Panel
 
-    setRange(start: number, end: number, resolution: number): void
+    // volatile is an amount of trailing buckets which are re-queried on every refresh of streaming range (end = 0)
+    // resolution is chosen by the server if it is "auto" or if explicit resolution doesn't fit into max points
+    setRange(start: number, end: number, resolution: number | "auto", volatile?: number): string
+
+    // from and to are time expressions resolved by the server on every refresh: now-6h, now-1d/d or absolute time
+    setRelativeRange(from: string, to: string, resolution: number | "auto", timezone?: string): string
+
+    // sliding range of the given size which ends at now(); points which fall out of it are evicted
+    setWindow(window: number, resolution: number | "auto", volatile?: number): string
+
+    // points budget (e.g. width of the chart in pixels) which is sent with every subsequent time command
+    setMaxPoints(maxPoints: number)
+
+    setConcurrency(concurrency: number): string
+
+    setRefresh(refresh: number): string
+
+    // visible panels are subset of active panels which queries are executed first
+    // filters replace series filters of the listed panels (empty filter removes it), filtered panels are reloaded
+    setActivePanels(ids: string[], visible?: string[], filters?: { [id: string]: PanelFilter }): string
+
+    resetPanels(ids: string[]): string
 
-    setConcurrency(concurrency: number): void
+    // changes values of the dashboard variables (session starts with their defaults); only panels which reference changed variables are re-queried
+    setVariables(values: { [name: string]: string }): string
+}
 
-    setRefresh(refresh: number): void
+// ad-hoc panel of the explore session: expression combines saved panels, query is accepted only if server enables explore queries
+interface ExplorePanel {
+    id: string
+    name?: string
+    query?: string
+    expression?: string
+    transform?: string
+    downsample?: string
+}
 
-    setActivePanels(ids: string[]): void
+interface ExploreBoard extends MetricBoard {
+    // replaces all ad-hoc panels of the session and activates them, panels with changed definition are reloaded
+    explore(panels: ExplorePanel[]): string
+}
+
+interface PanelUpdate {
+    id: string
+    request?: string
+    key?: string
+    type?: string
+    group?: string
+    labels?: { [key: string]: string }
+    error?: string
+    // append, prepend, replace or reset (drop all series of the panel)
+    mode?: string
+    // covered time range: previously received points of the series within it are superseded by the update points
+    from?: number
+    to?: number
+    // resolution of the points in microseconds chosen by the server
+    resolution?: number
+}
+
+interface CompleteUpdate {
+    request?: string
+    panel?: string
+}
+
+interface CancelledUpdate {
+    request?: string
+    panel: string
+}
 
-    resetPanels(ids: string[]): void
+interface TrimUpdate {
+    panel: string
+    key: string
+    before: number
+}
+
+interface MetricFrame {
+    update: PanelUpdate
+    timestamps: number[]
+    values: number[]
 }
 
 const F32Bin = 1
 const U64Bin = 2
+const MetricFrameBin = 3
+const U64DeltaBin = 4
+const F32XorBin = 5
 
-function getUint64(dataView: DataView): number {
-    const low = dataView.getUint32(0, true);
-    const high = dataView.getUint32(4, true);
+// column encodings supported by the client, server picks the most compact ones
+const SupportedEncodings = ["u64-delta", "f32-xor"]
+
+function getUint64(dataView: DataView, offset: number): number {
+    const low = dataView.getUint32(offset, true);
+    const high = dataView.getUint32(offset + 4, true);
     return low + high * (2 ** 32);
 }
 
-var newPanel = function (host: string, panelId: string): MetricBoard {
-    const metricboard = new WebSocket(`ws://${host}/panel?id=${panelId}`);
+function getUvarint(dataView: DataView, offset: number): [number, number] {
+    let result = 0, scale = 1, byte;
+    do {
+        byte = dataView.getUint8(offset++);
+        result += (byte & 0x7f) * scale;
+        scale *= 128;
+    } while (byte & 0x80);
+    return [result, offset];
+}
+
+function getVarint(dataView: DataView, offset: number): [number, number] {
+    const [zigzag, next] = getUvarint(dataView, offset);
+    return [zigzag % 2 == 1 ? -(zigzag + 1) / 2 : zigzag / 2, next];
+}
+
+// decodeColumn decodes single column starting at offset and returns decoded values with offset right after the column
+function decodeColumn(dataView: DataView, offset: number): [number[], number] {
+    const version = dataView.getUint8(offset);
+    const length = dataView.getUint32(offset + 1, true);
+    const values = [];
+    offset += 5;
+    switch (version) {
+        case F32Bin:
+            for (let i = 0; i < length; i++) {
+                values.push(dataView.getFloat32(offset + 4 * i, true));
+            }
+            return [values, offset + 4 * length];
+        case U64Bin:
+            for (let i = 0; i < length; i++) {
+                values.push(getUint64(dataView, offset + 8 * i));
+            }
+            return [values, offset + 8 * length];
+        case U64DeltaBin: {
+            let previous = 0, delta = 0, value;
+            for (let i = 0; i < length; i++) {
+                if (i == 0) {
+                    [previous, offset] = getUvarint(dataView, offset);
+                } else {
+                    [value, offset] = getVarint(dataView, offset);
+                    delta = i == 1 ? value : delta + value;
+                    previous += delta;
+                }
+                values.push(previous);
+            }
+            return [values, offset];
+        }
+        case F32XorBin: {
+            let position = offset * 8;
+            const read = (n: number): number => {
+                let result = 0;
+                for (let i = 0; i < n; i++, position++) {
+                    result = result * 2 + ((dataView.getUint8(position >> 3) >> (7 - position % 8)) & 1);
+                }
+                return result;
+            };
+            const bits = new DataView(new ArrayBuffer(4));
+            let previous = 0, leading = 0, trailing = 0;
+            for (let i = 0; i < length; i++) {
+                if (i == 0) {
+                    previous = read(32);
+                } else if (read(1) == 1) {
+                    if (read(1) == 1) {
+                        leading = read(5);
+                        trailing = 32 - leading - read(5) - 1;
+                    }
+                    previous = (previous ^ (read(32 - leading - trailing) << trailing)) >>> 0;
+                }
+                bits.setUint32(0, previous);
+                values.push(bits.getFloat32(0));
+            }
+            return [values, Math.ceil(position / 8)];
+        }
+    }
+    throw new Error(`unexpected column version: ${version}`);
+}
+
+function decodeMetricFrame(buffer: ArrayBuffer): MetricFrame {
+    const dataView = new DataView(buffer);
+    const version = dataView.getUint8(0);
+    if (version != MetricFrameBin) {
+        throw new Error(`unexpected frame version: ${version}`);
+    }
+    const headerLength = dataView.getUint32(1, true);
+    const update = JSON.parse(new TextDecoder().decode(new Uint8Array(buffer, 5, headerLength)));
+    const [timestamps, valuesOffset] = decodeColumn(dataView, 5 + headerLength);
+    const [values] = decodeColumn(dataView, valuesOffset);
+    return {update, timestamps, values};
+}
+
+function lowerBound(values: number[], value: number): number {
+    let left = 0, right = values.length;
+    while (left < right) {
+        const middle = (left + right) >> 1;
+        if (values[middle] < value) {
+            left = middle + 1;
+        } else {
+            right = middle;
+        }
+    }
+    return left;
+}
+
+// mergeSeries replaces points of the series within the covered range of the update with the new ones.
+// Splicing by the covered range is correct for every merge mode, so append/prepend are not special-cased
+function mergeSeries(series: Series, frame: MetricFrame) {
+    const left = lowerBound(series.timestamps, frame.update.from);
+    const right = lowerBound(series.timestamps, frame.update.to + 1);
+    series.timestamps = series.timestamps.slice(0, left).concat(frame.timestamps, series.timestamps.slice(right));
+    series.values = series.values.slice(0, left).concat(frame.values, series.values.slice(right));
+}
+
+type PanelState = { name: string, description: string, series: Map<string, Series> }
+
+// connect opens metricboard session; panels are registered either by the first message of the session or by the client itself
+function connect(url: string, name: string): [MetricBoard, Map<string, PanelState>, (command: object) => string] {
+    const metricboard = new WebSocket(url);
+    // frames must be applied in the order of arrival, so they are decoded synchronously
+    metricboard.binaryType = "arraybuffer";
+    const panels = new Map<string, PanelState>();
     metricboard.addEventListener("open", (event) => {
-        console.log(`metricboard for ${panelId} opened`)
+        console.log(`metricboard for ${name} opened`)
     });
     metricboard.addEventListener("close", (event) => {
-        console.log(`metricboard for ${panelId} closed`)
+        console.log(`metricboard for ${name} closed`)
     });
     metricboard.addEventListener("message", (event) => {
-        if (event.data instanceof Blob) {
-            event.data.arrayBuffer().then(buffer => {
-                const version = new DataView(buffer.slice(0, 1)).getUint8(0);
-                let length, values;
-                switch (version) {
-                    case F32Bin:
-                        length = new DataView(buffer.slice(1, 5)).getUint32(0, true);
-                        values = [];
-                        for (let i = 0; i < length; i++) {
-                            const value = new DataView(buffer.slice(5 + 4 * i, 5 + 4 * (i + 1))).getFloat32(0, true)
-                            values.push(value);
-                        }
-                        break
-                    case U64Bin:
-                        length = new DataView(buffer.slice(1, 5)).getUint32(0, true);
-                        values = [];
-                        for (let i = 0; i < length; i++) {
-                            const value = getUint64(new DataView(buffer.slice(5 + 8 * i, 5 + 8 * (i + 1))))
-                            values.push(value);
-                        }
-                }
-                console.info(length, values)
-            })
+        if (event.data instanceof ArrayBuffer) {
+            const frame = decodeMetricFrame(event.data);
+            const panel = panels.get(frame.update.id);
+            if (panel == null) {
+                return;
+            }
+            let series = panel.series.get(frame.update.key);
+            if (series == null) {
+                series = {key: frame.update.key, type: frame.update.type, group: frame.update.group, labels: frame.update.labels, timestamps: [], values: []};
+                panel.series.set(frame.update.key, series);
+            }
+            mergeSeries(series, frame);
+            return;
+        }
+        const message = JSON.parse(event.data);
+        if (message.panel != null && message.panel.mode == "reset") {
+            panels.get(message.panel.id)?.series.clear();
+        } else if (message.trim != null) {
+            const trim: TrimUpdate = message.trim;
+            const series = panels.get(trim.panel)?.series.get(trim.key);
+            if (series != null) {
+                const count = lowerBound(series.timestamps, trim.before);
+                series.timestamps = series.timestamps.slice(count);
+                series.values = series.values.slice(count);
+            }
+        } else if (message.panel == null && message.complete == null && message.cancelled == null) {
+            // first message describes the panel itself
+            panels.set(message.id, {name: message.name, description: message.description, series: new Map()});
+        } else {
+            console.info(message)
         }
     });
-    return {
+    let lastRequestId = 0;
+    let maxPoints: number = undefined;
+    const send = (command: object): string => {
+        const id = `${++lastRequestId}`;
+        metricboard.send(JSON.stringify({"id": id, ...command}));
+        return id;
+    };
+    return [{
         getPanel(id: string): Panel {
-            return null;
+            const panel = panels.get(id);
+            if (panel == null) {
+                return null;
+            }
+            return {name: panel.name, description: panel.description, series: [...panel.series.values()]};
+        },
+        resetPanels(ids: string[]): string {
+            return send({"panels": {"reset": ids}});
         },
-        resetPanels(ids: string[]) {
-            metricboard.send(JSON.stringify({"panels": {"reset": ids}}));
+        setActivePanels(ids: string[], visible?: string[], filters?: { [id: string]: PanelFilter }): string {
+            return send({"panels": {"active": ids, "visible": visible, "filters": filters}});
         },
-        setActivePanels(ids: string[]) {
-            metricboard.send(JSON.stringify({"panels": {"active": ids}}));
+        setConcurrency(concurrency: number): string {
+            return send({"concurrency": concurrency});
         },
-        setConcurrency(concurrency: number) {
-            metricboard.send(JSON.stringify({"concurrency": concurrency}));
+        setRefresh(refresh: number): string {
+            return send({"refresh": refresh});
         },
-        setRefresh(refresh: number) {
-            metricboard.send(JSON.stringify({"refresh": refresh}));
+        setRange(start: number, end: number, resolution: number | "auto", volatile?: number): string {
+            return send({"time": {"start": start, "end": end, "resolution": resolution, "maxPoints": maxPoints, "volatile": volatile}});
         },
-        setRange(start: number, end: number, resolution: number) {
-            metricboard.send(JSON.stringify({"time": {"start": start, "end": end, "resolution": resolution}}));
+        setRelativeRange(from: string, to: string, resolution: number | "auto", timezone?: string): string {
+            return send({"time": {"from": from, "to": to, "resolution": resolution, "maxPoints": maxPoints, "timezone": timezone}});
+        },
+        setWindow(window: number, resolution: number | "auto", volatile?: number): string {
+            return send({"time": {"window": window, "resolution": resolution, "maxPoints": maxPoints, "volatile": volatile}});
+        },
+        setMaxPoints(points: number) {
+            maxPoints = points;
+        },
+        setVariables(values: { [name: string]: string }): string {
+            return send({"variables": values});
+        }
+    }, panels, send];
+}
+
+var newPanel = function (host: string, panelId: string): MetricBoard {
+    const [board] = connect(`ws://${host}/panel?id=${panelId}&encodings=${SupportedEncodings.join(",")}`, panelId);
+    return board;
+}
+
+var newExplore = function (host: string): ExploreBoard {
+    const [board, panels, send] = connect(`ws://${host}/explore?encodings=${SupportedEncodings.join(",")}`, "explore");
+    return {
+        ...board,
+        explore(explorePanels: ExplorePanel[]): string {
+            const ids = new Set(explorePanels.map((panel) => panel.id));
+            for (const id of [...panels.keys()]) {
+                if (!ids.has(id)) {
+                    panels.delete(id);
+                }
+            }
+            for (const panel of explorePanels) {
+                if (!panels.has(panel.id)) {
+                    panels.set(panel.id, {name: panel.name ?? panel.id, description: "", series: new Map()});
+                }
+            }
+            return send({"explore": {"panels": explorePanels}});
         }
     };
 }
\ No newline at end of file
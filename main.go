@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/binary"
 	"encoding/json"
 	"hash/fnv"
@@ -12,6 +13,8 @@ import (
 
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
+
+	_ "modernc.org/sqlite"
 )
 
 type MetricLineType int
@@ -20,6 +23,8 @@ const (
 	InstanceMetricLineType MetricLineType = iota + 1
 	GroupMeanMetricLineType
 	GroupVarianceMetricLineType
+	EnvelopeMinMetricLineType
+	EnvelopeMaxMetricLineType
 )
 
 func (t MetricLineType) String() string {
@@ -30,15 +35,44 @@ func (t MetricLineType) String() string {
 		return "group-mean"
 	case GroupVarianceMetricLineType:
 		return "group-variance"
+	case EnvelopeMinMetricLineType:
+		return "envelope-min"
+	case EnvelopeMaxMetricLineType:
+		return "envelope-max"
+	}
+	return "unknown"
+}
+
+// MergeMode describes how points of the update must be merged with previously received points of the series
+type MergeMode int
+
+const (
+	AppendMergeMode  MergeMode = iota + 1 // covered range follows all received points
+	PrependMergeMode                      // covered range precedes all received points
+	ReplaceMergeMode                      // received points within covered range must be replaced
+	ResetMergeMode                        // all received points of the panel must be dropped
+)
+
+func (m MergeMode) String() string {
+	switch m {
+	case AppendMergeMode:
+		return "append"
+	case PrependMergeMode:
+		return "prepend"
+	case ReplaceMergeMode:
+		return "replace"
+	case ResetMergeMode:
+		return "reset"
 	}
 	return "unknown"
 }
 
 type Dashboard struct {
-	Id          string `json:"id"`
-	Title       string `json:"title"`
-	Description string `json:"description"`
-	Rows        []Row  `json:"rows"`
+	Id          string     `json:"id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Variables   []Variable `json:"variables,omitempty"`
+	Rows        []Row      `json:"rows"`
 }
 
 func (d Dashboard) Panels() []string {
@@ -64,50 +98,158 @@ type Panel struct {
 	Name        string `json:"name"`
 	Description string `json:"description"`
 	Units       string `json:"units"`
+	Query       string `json:"query,omitempty"`
+	Transform   string `json:"transform,omitempty"`  // rate, increase or derivative of every series
+	Downsample  string `json:"downsample,omitempty"` // avg, min, max or last aggregate of crowded buckets or lttb thinning
+	Envelope    bool   `json:"envelope,omitempty"`   // emit min and max lines of every bucket alongside instance lines
+	Expression  string `json:"expression,omitempty"` // derived panel computed from series of other panels, e.g. sum(errors) / sum(requests)
 }
 
 type PanelUpdate struct {
-	Id     string            `json:"id"`
-	Type   string            `json:"type,omitempty"`
-	Group  string            `json:"group,omitempty"`
-	Labels map[string]string `json:"labels,omitempty"`
-	Error  string            `json:"error,omitempty"`
+	Id         string            `json:"id"`
+	Request    string            `json:"request,omitempty"`
+	Key        string            `json:"key,omitempty"`
+	Type       string            `json:"type,omitempty"`
+	Group      string            `json:"group,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Mode       string            `json:"mode,omitempty"`
+	From       uint64            `json:"from,omitempty"` // covered time range of the update
+	To         uint64            `json:"to,omitempty"`
+	Resolution int64             `json:"resolution,omitempty"` // resolution of the points which can be chosen automatically by the server
+}
+
+// CompleteUpdate notifies that all queries of the panel (or of the whole command if panel is empty) were finished
+type CompleteUpdate struct {
+	Request string `json:"request,omitempty"`
+	Panel   string `json:"panel,omitempty"`
+}
+
+// CancelledUpdate notifies that panel query of the request was superseded by another command and cancelled
+type CancelledUpdate struct {
+	Request string `json:"request,omitempty"`
+	Panel   string `json:"panel"`
+}
+
+// TrimUpdate notifies that points of the series before the timestamp fell out of the sliding window and must be dropped
+type TrimUpdate struct {
+	Panel  string `json:"panel"`
+	Key    string `json:"key"`
+	Before uint64 `json:"before"`
 }
 
 type MetricBoardUpdates struct {
-	Panel *PanelUpdate `json:"panel,omitempty"`
+	Panel     *PanelUpdate     `json:"panel,omitempty"`
+	Complete  *CompleteUpdate  `json:"complete,omitempty"`
+	Cancelled *CancelledUpdate `json:"cancelled,omitempty"`
+	Trim      *TrimUpdate      `json:"trim,omitempty"`
+}
+
+// TimeResolution is a resolution in microseconds; "auto" (or 0) lets the server choose it according to the points budget
+type TimeResolution int64
+
+func (r *TimeResolution) UnmarshalJSON(data []byte) error {
+	if string(data) == `"auto"` {
+		*r = 0
+		return nil
+	}
+	return json.Unmarshal(data, (*int64)(r))
 }
 
 type MetricBoardTimeUpdateCommand struct {
-	Start      int64 `json:"start"`
-	End        int64 `json:"end"` // 0 if you want to enable streaming until now()
-	Resolution int64 `json:"resolution"`
+	Start      int64          `json:"start"`
+	End        int64          `json:"end"` // 0 if you want to enable streaming until now()
+	Resolution TimeResolution `json:"resolution"`
+	MaxPoints  int64          `json:"maxPoints,omitempty"` // budget of points per series; explicit resolution is coarsened if it doesn't fit
+	Volatile   *int           `json:"volatile,omitempty"`  // amount of trailing buckets which are re-queried on every refresh of streaming query
+	Window     int64          `json:"window,omitempty"`    // if set, start is ignored and the range slides with now() keeping this size
+	// From and To override start and end with time expressions (now-6h, now-1d/d) which are resolved on every refresh
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+	Timezone string `json:"timezone,omitempty"` // IANA timezone name for calendar alignment; UTC by default
 }
 
 type MetricBoardPanelsUpdateCommand struct {
-	ActivePanelIds []string `json:"active"`
-	ResetPanelIds  []string `json:"reset"`
+	ActivePanelIds  []string `json:"active"`
+	ResetPanelIds   []string `json:"reset"`
+	VisiblePanelIds []string `json:"visible"` // subset of active panels which queries are executed first
+	// Filters replace series filters of the listed panels (empty filter removes it); filtered panels are reset
+	Filters map[string]PanelFilter `json:"filters,omitempty"`
+}
+
+// MetricBoardExploreCommand replaces all ad-hoc panels of the explore session; Query and Expression of the panels are
+// evaluated exactly as for the saved panels. Query is accepted only if explore queries are enabled by the server
+type MetricBoardExploreCommand struct {
+	Panels []Panel `json:"panels"`
 }
 
 type MetricBoardCommands struct {
+	Id                string                          `json:"id,omitempty"` // echoed in all updates caused by the command
 	TimeUpdate        *MetricBoardTimeUpdateCommand   `json:"time,omitempty"`
 	PanelsUpdate      *MetricBoardPanelsUpdateCommand `json:"panels,omitempty"`
 	ConcurrencyUpdate *int                            `json:"concurrency"`
 	RefreshUpdate     *int                            `json:"refresh"`
+	VariablesUpdate   map[string]string               `json:"variables,omitempty"` // new values of the changed dashboard variables
+	ExploreUpdate     *MetricBoardExploreCommand      `json:"explore,omitempty"`   // accepted only by the explore session
 }
 
 type DataSource interface {
 	GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error
 }
 
+type PanelProvider interface {
+	GetPanel(ctx context.Context, panelId string) (Panel, error)
+}
+
 type MetricBoard interface {
 	DataSource
+	PanelProvider
 	GetDashboard(ctx context.Context, dashboardId string) (Dashboard, error)
-	GetPanel(ctx context.Context, panelId string) (Panel, error)
+}
+
+type dataSourceMetricBoard struct {
+	MetricBoard
+	dataSource DataSource
+}
+
+func (b dataSourceMetricBoard) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
+	return b.dataSource.GetMetric(ctx, panelId, query, metrics)
+}
+
+type streamingDataSourceMetricBoard struct {
+	dataSourceMetricBoard
+	streamingDataSource StreamingDataSource
+}
+
+func (b streamingDataSourceMetricBoard) Subscribe(ctx context.Context, panelId string, from time.Time, resolution time.Duration, metrics chan<- Metric) error {
+	return b.streamingDataSource.Subscribe(ctx, panelId, from, resolution, metrics)
+}
+
+// WithDataSource returns MetricBoard which serves dashboards and panels from the board and metrics from the data source
+func WithDataSource(board MetricBoard, dataSource DataSource) MetricBoard {
+	if streamingDataSource, ok := dataSource.(StreamingDataSource); ok {
+		return streamingDataSourceMetricBoard{
+			dataSourceMetricBoard: dataSourceMetricBoard{MetricBoard: board, dataSource: dataSource},
+			streamingDataSource:   streamingDataSource,
+		}
+	}
+	return dataSourceMetricBoard{MetricBoard: board, dataSource: dataSource}
 }
 
 const (
-	MaxPanelDataPoints = 100_000
+	MaxPanelDataPoints       = 100_000
+	DashboardsReloadInterval = time.Second
+	MemoryStorageRetention   = 24 * time.Hour
+	// DefaultSessionConcurrency is a concurrency limit of the session until client requests another one
+	DefaultSessionConcurrency = 1
+	VisiblePanelPriority      = 1
+	HiddenPanelPriority       = 0
+	// DefaultVolatileBuckets is an amount of trailing buckets of streaming query which can still receive late points
+	DefaultVolatileBuckets = 1
+	// DefaultAutoMaxPoints is a points budget of the query with automatic resolution if client didn't provide one
+	DefaultAutoMaxPoints = 1_000
+	// WindowTrimInterval is a period of eviction of points which fell out of the sliding window
+	WindowTrimInterval = time.Second
 )
 
 type MockMetricBoard struct{}
@@ -153,7 +295,7 @@ func (m MockMetricBoard) GetPanel(ctx context.Context, panelId string) (Panel, e
 
 func (m MockMetricBoard) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
 	resolution := query.Resolution.Microseconds()
-	start := query.StartTime.UnixMicro() + (resolution-query.StartTime.UnixMicro())%resolution
+	start := query.StartTime.UnixMicro() + (resolution-query.StartTime.UnixMicro()%resolution)%resolution
 	end := query.EndTime.UnixMicro() - query.EndTime.UnixMicro()%resolution
 	timestamps, values := make([]uint64, 0), make([]float32, 0)
 	for start <= end {
@@ -176,19 +318,111 @@ func (m MockMetricBoard) GetMetric(ctx context.Context, panelId string, query Me
 	return nil
 }
 
+// ListPanels lists panels of the mock dashboard
+func (m MockMetricBoard) ListPanels(ctx context.Context) ([]Panel, error) {
+	dashboard, err := m.GetDashboard(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	panels := make([]Panel, 0)
+	for _, row := range dashboard.Rows {
+		panels = append(panels, row.Panels...)
+	}
+	return panels, nil
+}
+
 var (
-	metricboardLocal = EnvTryParseBool("METRICBOARD_LOCAL")
+	metricboardLocal         = EnvTryParseBool("METRICBOARD_LOCAL")
+	metricboardDashboardsDir = EnvTryParseString("METRICBOARD_DASHBOARDS_DIR", "")
+	metricboardPrometheusUrl = EnvTryParseString("METRICBOARD_PROMETHEUS_URL", "")
+	metricboardMemoryStorage = EnvTryParseBool("METRICBOARD_MEMORY_STORAGE")
+	metricboardSqlDriver     = EnvTryParseString("METRICBOARD_SQL_DRIVER", "sqlite")
+	metricboardSqlDsn        = EnvTryParseString("METRICBOARD_SQL_DSN", "")
+	metricboardConcurrency   = EnvTryParseInt("METRICBOARD_CONCURRENCY", 16)
+	// metricboardExploreQueries allows raw queries in ad-hoc panels of explore sessions; sql data source additionally
+	// requires separate dsn with read-only access which is used by explore sessions
+	metricboardExploreQueries = EnvTryParseBool("METRICBOARD_EXPLORE_QUERIES")
+	metricboardExploreSqlDsn  = EnvTryParseString("METRICBOARD_EXPLORE_SQL_DSN", "")
 )
 
 func main() {
-	var metricBoard MetricBoard = MockMetricBoard{}
+	var (
+		metricBoard MetricBoard = MockMetricBoard{}
+		panelLister PanelLister = MockMetricBoard{}
+	)
+	if metricboardDashboardsDir != "" {
+		fileMetricBoard, err := NewFileMetricBoard(metricboardDashboardsDir, MockMetricBoard{})
+		if err != nil {
+			Logger.Fatalf("failed to load dashboards: dir=%v, err=%v", metricboardDashboardsDir, err)
+		}
+		go fileMetricBoard.Watch(context.Background(), DashboardsReloadInterval)
+		metricBoard, panelLister = fileMetricBoard, fileMetricBoard
+	}
+	mux := http.NewServeMux()
+	// labels are listed only by data sources which support the catalog
+	var labelsCatalog CatalogDataSource
+	// withDataSources builds data sources chain on top of the board; explore sessions build their own chain on top of
+	// the board with ad-hoc panels since data sources look panels up by id
+	withDataSources := func(board MetricBoard) MetricBoard { return board }
+	var withExploreDataSources func(board MetricBoard) MetricBoard
+	if metricboardPrometheusUrl != "" {
+		labelsCatalog = NewPrometheusDataSource(metricboardPrometheusUrl, metricBoard)
+		withDataSources = func(board MetricBoard) MetricBoard {
+			return WithDataSource(board, NewPrometheusDataSource(metricboardPrometheusUrl, board))
+		}
+	} else if metricboardMemoryStorage {
+		storage := NewMemoryStorage(MemoryStorageRetention)
+		mux.Handle("/ingest", storage.IngestHandler())
+		labelsCatalog = storage
+		withDataSources = func(board MetricBoard) MetricBoard { return WithDataSource(board, storage) }
+	} else if metricboardSqlDsn != "" {
+		db, err := sql.Open(metricboardSqlDriver, metricboardSqlDsn)
+		if err != nil {
+			Logger.Fatalf("failed to open sql database: driver=%v, err=%v", metricboardSqlDriver, err)
+		}
+		placeholder := QuestionSqlPlaceholder
+		if metricboardSqlDriver == "postgres" || metricboardSqlDriver == "pgx" {
+			placeholder = DollarSqlPlaceholder
+		}
+		withDataSources = func(board MetricBoard) MetricBoard {
+			return WithDataSource(board, NewSqlDataSource(db, placeholder, board))
+		}
+		if metricboardExploreQueries {
+			if metricboardExploreSqlDsn == "" {
+				Logger.Fatalf("explore queries over sql data source require read-only dsn: METRICBOARD_EXPLORE_SQL_DSN")
+			}
+			exploreDb, err := sql.Open(metricboardSqlDriver, metricboardExploreSqlDsn)
+			if err != nil {
+				Logger.Fatalf("failed to open explore sql database: driver=%v, err=%v", metricboardSqlDriver, err)
+			}
+			withExploreDataSources = func(board MetricBoard) MetricBoard {
+				return WithDataSource(board, NewSqlDataSource(exploreDb, placeholder, board))
+			}
+		}
+	}
+	// sql data source doesn't list labels since its queries are arbitrary statements, only panels are listed then
+	mux.Handle("/catalog/", CatalogHandler(BoardCatalog(panelLister, labelsCatalog)))
+	if withExploreDataSources == nil {
+		withExploreDataSources = withDataSources
+	}
+	withPanelDataSources := func(board MetricBoard, withDataSources func(board MetricBoard) MetricBoard) MetricBoard {
+		board = withDataSources(board)
+		board = WithDataSource(board, WithExpressions(board, board))
+		return WithDataSource(board, WithPanelTransforms(board, board))
+	}
+	savedMetricBoard := metricBoard
+	metricBoard = withPanelDataSources(metricBoard, withDataSources)
+
+	workerPool := NewSharedWorkerPool(context.Background(), int(metricboardConcurrency))
+	workerPool.Start()
+	defer workerPool.Stop()
 
-	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+	mux.Handle("/", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		Logger.Infof("start http request processing: uri=%v", request.RequestURI)
 		path := request.URL.Path
 		entityId := request.URL.Query().Get("id")
 
-		if path != "/dashboard" && path != "/panel" {
+		if path != "/dashboard" && path != "/panel" && path != "/explore" {
 			Logger.Errorf("unexpected path '%v'", path)
 			writer.WriteHeader(http.StatusBadRequest)
 			return
@@ -202,14 +436,28 @@ func main() {
 			return
 		}
 
-		var panels []string
-		if path == "/dashboard" {
+		var (
+			panels    []string
+			variables []Variable
+		)
+		sessionMetricBoard := metricBoard
+		var explore *ExploreMetricBoard
+		if path == "/explore" {
+			// explore session starts without panels, they are defined by the explore commands
+			explore = NewExploreMetricBoard(savedMetricBoard, metricboardExploreQueries)
+			sessionMetricBoard = withPanelDataSources(explore, withExploreDataSources)
+			panels = []string{}
+		} else if path == "/dashboard" {
 			dashboard, err := metricBoard.GetDashboard(request.Context(), entityId)
 			if err != nil {
 				Logger.Errorf("unable to fetch dashboard details: id=%v, err=%v", entityId, err)
 				_ = c.Close(http.StatusInternalServerError, "unable to fetch dashboard details")
 				return
 			}
+			// discovery queries share the server-wide concurrency limit with the panel queries
+			discovery := workerPool.NewSession(request.Context(), DefaultSessionConcurrency)
+			dashboard = ResolveDashboardVariables(discovery, metricBoard, dashboard, time.Now())
+			discovery.Close()
 			dashboardBytes, err := json.Marshal(dashboard)
 			if err != nil {
 				Logger.Errorf("unable to serialize dashboard details: id=%v, err=%v", entityId, err)
@@ -220,7 +468,7 @@ func main() {
 				_ = c.Close(http.StatusInternalServerError, "failed to write dashboard details")
 				return
 			}
-			panels = dashboard.Panels()
+			panels, variables = dashboard.Panels(), dashboard.Variables
 		} else if path == "/panel" {
 			panel, err := metricBoard.GetPanel(request.Context(), entityId)
 			if err != nil {
@@ -241,6 +489,8 @@ func main() {
 			panels = []string{entityId}
 		}
 
+		encoding := NegotiateFrameEncoding(request.URL.Query().Get("encodings"))
+
 		ctx, cancel := context.WithCancel(request.Context())
 		defer cancel()
 
@@ -250,30 +500,60 @@ func main() {
 			return command, err
 		})
 		results := NewStreamingWriter[MetricResult](ctx, 0, func(result MetricResult) {
-			if result.Err != nil {
-				update := &MetricBoardUpdates{Panel: &PanelUpdate{Id: result.PanelId, Error: result.Err.Error()}}
+			if result.Cancelled {
+				update := &MetricBoardUpdates{Cancelled: &CancelledUpdate{Request: result.RequestId, Panel: result.PanelId}}
 				updateBytes, _ := json.Marshal(update)
 				_ = c.Write(ctx, websocket.MessageText, updateBytes)
-			} else {
+			} else if result.Complete {
+				update := &MetricBoardUpdates{Complete: &CompleteUpdate{Request: result.RequestId, Panel: result.PanelId}}
+				updateBytes, _ := json.Marshal(update)
+				_ = c.Write(ctx, websocket.MessageText, updateBytes)
+			} else if result.Err != nil {
+				update := &MetricBoardUpdates{Panel: &PanelUpdate{Id: result.PanelId, Request: result.RequestId, Error: result.Err.Error()}}
+				updateBytes, _ := json.Marshal(update)
+				_ = c.Write(ctx, websocket.MessageText, updateBytes)
+			} else if !result.TrimBefore.IsZero() {
+				update := &MetricBoardUpdates{Trim: &TrimUpdate{Panel: result.PanelId, Key: result.Metric.Key(), Before: uint64(result.TrimBefore.UnixMicro())}}
+				updateBytes, _ := json.Marshal(update)
+				_ = c.Write(ctx, websocket.MessageText, updateBytes)
+			} else if result.Mode == ResetMergeMode {
 				update := &MetricBoardUpdates{Panel: &PanelUpdate{
-					Id:     result.PanelId,
-					Type:   result.Metric.Type.String(),
-					Group:  result.Metric.Group,
-					Labels: result.Metric.Labels,
+					Id:         result.PanelId,
+					Request:    result.RequestId,
+					Mode:       result.Mode.String(),
+					From:       uint64(result.Covered.Start.UnixMicro()),
+					To:         uint64(result.Covered.End.UnixMicro()),
+					Resolution: result.Resolution.Microseconds(),
 				}}
 				updateBytes, _ := json.Marshal(update)
 				_ = c.Write(ctx, websocket.MessageText, updateBytes)
-				_ = c.Write(ctx, websocket.MessageBinary, EncodeU64(result.Metric.Timestamps))
-				_ = c.Write(ctx, websocket.MessageBinary, EncodeF32(result.Metric.Values))
+			} else {
+				update := &PanelUpdate{
+					Id:         result.PanelId,
+					Request:    result.RequestId,
+					Key:        result.Metric.Key(),
+					Type:       result.Metric.Type.String(),
+					Group:      result.Metric.Group,
+					Labels:     result.Metric.Labels,
+					Mode:       result.Mode.String(),
+					From:       uint64(result.Covered.Start.UnixMicro()),
+					To:         uint64(result.Covered.End.UnixMicro()),
+					Resolution: result.Resolution.Microseconds(),
+				}
+				updateBytes, _ := json.Marshal(update)
+				_ = c.Write(ctx, websocket.MessageBinary, EncodeMetricFrame(encoding, updateBytes, result.Metric.Timestamps, result.Metric.Values))
 			}
 		})
-		SubscribeToPanels(ctx, metricBoard, panels, commands, results)
+		if explore != nil {
+			commands = ExploreCommands(ctx, explore, commands, results)
+		}
+		SubscribeToPanels(ctx, sessionMetricBoard, workerPool, panels, variables, commands, results)
 
 		defer func() {
 			Logger.Infof("finish http request processing: uri=%v", request.RequestURI)
 		}()
-	})
-	err := http.ListenAndServe(":8000", handler)
+	}))
+	err := http.ListenAndServe(":8000", mux)
 	if err != nil {
 		Logger.Errorf("server exited with error: %v", err)
 	}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	MemoryChunkSize = 512
+	// MemorySweepInterval is a minimal period between sweeps of all series which drop samples older than retention
+	MemorySweepInterval = time.Minute
+	// MaxIngestRequestSize limits size of the ingest request body
+	MaxIngestRequestSize = 32 << 20
+)
+
+type memoryChunk struct {
+	timestamps []uint64
+	values     []float32
+}
+
+type memorySeries struct {
+	group  string
+	labels map[string]string
+	chunks []*memoryChunk
+}
+
+func (s *memorySeries) last() (uint64, bool) {
+	if len(s.chunks) == 0 {
+		return 0, false
+	}
+	chunk := s.chunks[len(s.chunks)-1]
+	return chunk.timestamps[len(chunk.timestamps)-1], true
+}
+
+func (s *memorySeries) append(timestamp uint64, value float32) {
+	if len(s.chunks) == 0 || len(s.chunks[len(s.chunks)-1].timestamps) == MemoryChunkSize {
+		s.chunks = append(s.chunks, &memoryChunk{
+			timestamps: make([]uint64, 0, MemoryChunkSize),
+			values:     make([]float32, 0, MemoryChunkSize),
+		})
+	}
+	chunk := s.chunks[len(s.chunks)-1]
+	chunk.timestamps = append(chunk.timestamps, timestamp)
+	chunk.values = append(chunk.values, value)
+}
+
+// truncate drops chunks which are completely older than the given timestamp
+func (s *memorySeries) truncate(before uint64) {
+	drop := 0
+	for drop < len(s.chunks) && s.chunks[drop].timestamps[len(s.chunks[drop].timestamps)-1] < before {
+		drop++
+	}
+	s.chunks = s.chunks[drop:]
+}
+
+// MemoryStorage is an embedded append-only time-series store.
+// Series are identified by panel id and group/labels pair, every series is stored as a list of fixed-size chunks
+type MemoryStorage struct {
+	lock      sync.RWMutex
+	retention time.Duration
+	lastSweep time.Time
+	series    map[string]map[string]*memorySeries
+	listeners map[string]map[chan struct{}]struct{}
+}
+
+func NewMemoryStorage(retention time.Duration) *MemoryStorage {
+	return &MemoryStorage{
+		retention: retention,
+		series:    make(map[string]map[string]*memorySeries),
+		listeners: make(map[string]map[chan struct{}]struct{}),
+	}
+}
+
+// Append adds samples to the series; samples must be sorted and must not precede already stored ones
+func (s *MemoryStorage) Append(panelId string, group string, labels map[string]string, timestamps []uint64, values []float32) error {
+	if len(timestamps) != len(values) {
+		return fmt.Errorf("timestamps and values length mismatch: %v != %v", len(timestamps), len(values))
+	}
+	for i := 1; i < len(timestamps); i++ {
+		if timestamps[i] < timestamps[i-1] {
+			return fmt.Errorf("timestamps must be sorted: %v > %v", timestamps[i-1], timestamps[i])
+		}
+	}
+	key := group + "|" + LabelsKey(labels)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	panelSeries, ok := s.series[panelId]
+	if !ok {
+		panelSeries = make(map[string]*memorySeries)
+		s.series[panelId] = panelSeries
+	}
+	series, ok := panelSeries[key]
+	if !ok {
+		series = &memorySeries{group: group, labels: labels}
+		panelSeries[key] = series
+	}
+	if last, ok := series.last(); ok && len(timestamps) > 0 && timestamps[0] < last {
+		return fmt.Errorf("out of order sample for series: panel=%v, key=%v, last=%v, timestamp=%v", panelId, key, last, timestamps[0])
+	}
+	for i := range timestamps {
+		series.append(timestamps[i], values[i])
+	}
+	if s.retention > 0 {
+		now := time.Now()
+		series.truncate(uint64(now.Add(-s.retention).UnixMicro()))
+		if now.Sub(s.lastSweep) >= MemorySweepInterval {
+			s.sweep(now)
+		}
+	}
+	for listener := range s.listeners[panelId] {
+		select {
+		case listener <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// sweep truncates all series to the retention and removes series which have no samples left, so series which stopped
+// receiving samples don't stay in memory forever; must be called under the write lock
+func (s *MemoryStorage) sweep(now time.Time) {
+	s.lastSweep = now
+	before := uint64(now.Add(-s.retention).UnixMicro())
+	for panelId, panelSeries := range s.series {
+		for key, series := range panelSeries {
+			series.truncate(before)
+			if len(series.chunks) == 0 {
+				delete(panelSeries, key)
+			}
+		}
+		if len(panelSeries) == 0 {
+			delete(s.series, panelId)
+		}
+	}
+}
+
+// Subscribe pushes points appended to the panel series after the given time. Every push re-queries the bucket of the
+// previous push from its start, so the bucket value is averaged over all its samples. Samples are expected to be ingested
+// in real time, so points with timestamps older than the bucket of previous push are not delivered
+func (s *MemoryStorage) Subscribe(ctx context.Context, panelId string, from time.Time, resolution time.Duration, metrics chan<- Metric) error {
+	if resolution.Microseconds() == 0 {
+		return fmt.Errorf("zero resolution is not supported")
+	}
+	listener := make(chan struct{}, 1)
+	s.lock.Lock()
+	if _, ok := s.listeners[panelId]; !ok {
+		s.listeners[panelId] = make(map[chan struct{}]struct{})
+	}
+	s.listeners[panelId][listener] = struct{}{}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.listeners[panelId], listener)
+		if len(s.listeners[panelId]) == 0 {
+			delete(s.listeners, panelId)
+		}
+		s.lock.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-listener:
+		}
+		now := time.Now()
+		bucket := time.UnixMicro(from.UnixMicro() - from.UnixMicro()%resolution.Microseconds())
+		if err := s.GetMetric(ctx, panelId, MetricQuery{StartTime: bucket, EndTime: now, Resolution: resolution}, metrics); err != nil {
+			return err
+		}
+		from = now
+	}
+}
+
+// GetMetric aggregates samples of every panel series into buckets of query resolution size by averaging values within a bucket
+func (s *MemoryStorage) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
+	start, end := uint64(query.StartTime.UnixMicro()), uint64(query.EndTime.UnixMicro())
+	resolution := uint64(query.Resolution.Microseconds())
+	if resolution == 0 {
+		return fmt.Errorf("zero resolution is not supported")
+	}
+
+	s.lock.RLock()
+	result := make([]Metric, 0, len(s.series[panelId]))
+	for _, series := range s.series[panelId] {
+		metric := Metric{
+			PanelId:    panelId,
+			Type:       InstanceMetricLineType,
+			Group:      series.group,
+			Labels:     series.labels,
+			Timestamps: make([]uint64, 0),
+			Values:     make([]float32, 0),
+		}
+		var (
+			bucket = uint64(0)
+			sum    = float64(0)
+			count  = 0
+		)
+		flush := func() {
+			if count > 0 {
+				metric.Timestamps = append(metric.Timestamps, bucket)
+				metric.Values = append(metric.Values, float32(sum/float64(count)))
+			}
+			sum, count = 0, 0
+		}
+		for _, chunk := range series.chunks {
+			if chunk.timestamps[len(chunk.timestamps)-1] < start || chunk.timestamps[0] > end {
+				continue
+			}
+			i := sort.Search(len(chunk.timestamps), func(i int) bool { return chunk.timestamps[i] >= start })
+			for ; i < len(chunk.timestamps) && chunk.timestamps[i] <= end; i++ {
+				current := chunk.timestamps[i] - chunk.timestamps[i]%resolution
+				if current != bucket {
+					flush()
+					bucket = current
+				}
+				sum += float64(chunk.values[i])
+				count++
+			}
+		}
+		flush()
+		if len(metric.Timestamps) > 0 {
+			result = append(result, metric)
+		}
+	}
+	s.lock.RUnlock()
+
+	for _, metric := range result {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case metrics <- metric:
+		}
+	}
+	return nil
+}
+
+type IngestSeries struct {
+	PanelId    string            `json:"panel"`
+	Group      string            `json:"group,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Timestamps []uint64          `json:"timestamps"`
+	Values     []float32         `json:"values"`
+}
+
+type IngestRequest struct {
+	Series []IngestSeries `json:"series"`
+}
+
+// IngestHandler accepts POST requests with IngestRequest json body and appends all series to the storage
+func (s *MemoryStorage) IngestHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var ingest IngestRequest
+		if err := json.NewDecoder(http.MaxBytesReader(writer, request.Body, MaxIngestRequestSize)).Decode(&ingest); err != nil {
+			Logger.Errorf("failed to parse ingest request: err=%v", err)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(writer, "ingest request is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(writer, "invalid ingest request", http.StatusBadRequest)
+			return
+		}
+		for _, series := range ingest.Series {
+			if series.PanelId == "" {
+				http.Error(writer, "empty panel id", http.StatusBadRequest)
+				return
+			}
+			if err := s.Append(series.PanelId, series.Group, series.Labels, series.Timestamps, series.Values); err != nil {
+				Logger.Errorf("failed to append series: panel=%v, err=%v", series.PanelId, err)
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// MetricNames lists panels which have stored series
+func (s *MemoryStorage) MetricNames(ctx context.Context, prefix string) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	names := make([]string, 0, len(s.series))
+	for panelId := range s.series {
+		names = append(names, panelId)
+	}
+	return CatalogEntries(names, prefix), nil
+}
+
+// catalogLabels collects label keys (or values of the label if it's not empty) of the panel series or of all series
+func (s *MemoryStorage) catalogLabels(metric string, label string, prefix string) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	entries := make([]string, 0)
+	for panelId, panelSeries := range s.series {
+		if metric != "" && panelId != metric {
+			continue
+		}
+		for _, series := range panelSeries {
+			for key, value := range series.labels {
+				if label == "" {
+					entries = append(entries, key)
+				} else if key == label {
+					entries = append(entries, value)
+				}
+			}
+		}
+	}
+	return CatalogEntries(entries, prefix)
+}
+
+func (s *MemoryStorage) LabelKeys(ctx context.Context, metric string, prefix string) ([]string, error) {
+	return s.catalogLabels(metric, "", prefix), nil
+}
+
+func (s *MemoryStorage) LabelValues(ctx context.Context, metric string, label string, prefix string) ([]string, error) {
+	return s.catalogLabels(metric, label, prefix), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	t.Run("bucketing", func(t *testing.T) {
+		storage := NewMemoryStorage(0)
+		timestamps, values := make([]uint64, 0), make([]float32, 0)
+		for i := 0; i < 2*MemoryChunkSize; i++ {
+			timestamps = append(timestamps, uint64(i*1000))
+			values = append(values, float32(i%2))
+		}
+		require.Nil(t, storage.Append("p-1", "g", map[string]string{"host": "a"}, timestamps, values))
+		require.NotNil(t, storage.Append("p-1", "g", map[string]string{"host": "a"}, []uint64{0}, []float32{0}))
+
+		metrics := make(chan Metric, 1)
+		require.Nil(t, storage.GetMetric(context.Background(), "p-1", MetricQuery{
+			StartTime:  time.UnixMicro(500_000),
+			EndTime:    time.UnixMicro(510_000),
+			Resolution: 4 * time.Millisecond,
+		}, metrics))
+		metric := <-metrics
+		require.Equal(t, "g", metric.Group)
+		require.Equal(t, map[string]string{"host": "a"}, metric.Labels)
+		require.Equal(t, []uint64{500_000, 504_000, 508_000}, metric.Timestamps)
+		require.Equal(t, []float32{0.5, 0.5, 1.0 / 3}, metric.Values)
+	})
+	t.Run("subscribe re-queries last bucket", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		storage := NewMemoryStorage(0)
+		// bucket is large enough to keep all samples of the test
+		resolution := 1000 * time.Hour
+		metrics := make(chan Metric)
+		go func() { _ = storage.Subscribe(ctx, "p-1", time.Now(), resolution, metrics) }()
+		require.Eventually(t, func() bool {
+			storage.lock.RLock()
+			defer storage.lock.RUnlock()
+			return len(storage.listeners["p-1"]) > 0
+		}, 5*time.Second, time.Millisecond)
+
+		now := time.Now().UnixMicro()
+		bucket := uint64(now - now%resolution.Microseconds())
+		require.Nil(t, storage.Append("p-1", "", nil, []uint64{uint64(time.Now().UnixMicro())}, []float32{1}))
+		metric := <-metrics
+		require.Equal(t, []uint64{bucket}, metric.Timestamps)
+		require.Equal(t, []float32{1}, metric.Values)
+		// the same bucket is pushed again with value averaged over all its samples
+		require.Nil(t, storage.Append("p-1", "", nil, []uint64{uint64(time.Now().UnixMicro())}, []float32{3}))
+		metric = <-metrics
+		require.Equal(t, []uint64{bucket}, metric.Timestamps)
+		require.Equal(t, []float32{2}, metric.Values)
+	})
+	t.Run("sweep drops expired series", func(t *testing.T) {
+		storage := NewMemoryStorage(time.Hour)
+		now := time.Now()
+		require.Nil(t, storage.Append("p-1", "", map[string]string{"pod": "a"}, []uint64{uint64(now.Add(-30 * time.Minute).UnixMicro())}, []float32{1}))
+		require.Nil(t, storage.Append("p-1", "", map[string]string{"pod": "b"}, []uint64{uint64(now.UnixMicro())}, []float32{1}))
+		require.Nil(t, storage.Append("p-2", "", map[string]string{"pod": "a"}, []uint64{uint64(now.Add(-30 * time.Minute).UnixMicro())}, []float32{1}))
+
+		storage.lock.Lock()
+		storage.sweep(now.Add(45 * time.Minute))
+		storage.lock.Unlock()
+		require.Len(t, storage.series, 1)
+		require.Len(t, storage.series["p-1"], 1)
+		names, err := storage.MetricNames(context.Background(), "")
+		require.Nil(t, err)
+		require.Equal(t, []string{"p-1"}, names)
+	})
+	t.Run("ingest", func(t *testing.T) {
+		storage := NewMemoryStorage(0)
+		handler := storage.IngestHandler()
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(
+			`{"series": [{"panel": "p-1", "labels": {"host": "a"}, "timestamps": [1000, 2000], "values": [1, 2]}]}`,
+		)))
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(
+			`{"series": [{"panel": "p-1", "timestamps": [1000], "values": []}]}`,
+		)))
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(
+			`{"series": [{"panel": "`+strings.Repeat("p", MaxIngestRequestSize)+`"}]}`,
+		)))
+		require.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+
+		metrics := make(chan Metric, 1)
+		require.Nil(t, storage.GetMetric(context.Background(), "p-1", MetricQuery{
+			StartTime:  time.UnixMicro(0),
+			EndTime:    time.UnixMicro(10_000),
+			Resolution: time.Millisecond,
+		}, metrics))
+		require.Equal(t, []float32{1, 2}, (<-metrics).Values)
+	})
+}
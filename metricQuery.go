@@ -8,39 +8,194 @@ type MetricQuery struct {
 	StartTime  time.Time
 	EndTime    time.Time
 	Resolution time.Duration
+	// From and To are relative boundaries of the query which are resolved on every refresh; nil for absolute ones
+	From     *TimeExpression
+	To       *TimeExpression
+	Location *time.Location // timezone for calendar alignment of relative boundaries
+	// MaxPoints is set if Resolution is only the lower bound and actual one is chosen on every refresh to fit the points budget
+	MaxPoints int64
+	Variables map[string]string // values of the dashboard variables referenced as $name from panel queries
+}
+
+// NiceResolutions are resolutions which are chosen automatically, they are aligned well with the calendar
+var NiceResolutions = []time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second, 15 * time.Second, 30 * time.Second,
+	time.Minute, 2 * time.Minute, 5 * time.Minute, 10 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 2 * time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour,
+	24 * time.Hour, 7 * 24 * time.Hour, 30 * 24 * time.Hour,
+}
+
+// ChooseResolution returns minimal resolution (if it fits) or the finest nice resolution which keeps amount of points within the budget
+func ChooseResolution(span time.Duration, minimal time.Duration, maxPoints int64) time.Duration {
+	if minimal > 0 && int64(span/minimal) <= maxPoints {
+		return minimal
+	}
+	for _, resolution := range NiceResolutions {
+		if resolution >= minimal && int64(span/resolution) <= maxPoints {
+			return resolution
+		}
+	}
+	return NiceResolutions[len(NiceResolutions)-1]
+}
+
+// Live returns true if the end of the query follows now()
+func (q MetricQuery) Live() bool {
+	if q.To != nil {
+		return q.To.IsNow()
+	}
+	return q.EndTime == time.UnixMicro(0)
+}
+
+// Sliding returns true if the start of the query moves with now()
+func (q MetricQuery) Sliding() bool {
+	return q.From != nil && q.From.Relative
 }
 
 func BeforeOrSame(a, b time.Time) bool        { return a == b || a.Before(b) }
 func AfterOrSame(a, b time.Time) bool         { return a == b || a.After(b) }
 func Within(a time.Time, l, r time.Time) bool { return a == l || a == r || (a.Before(l) && a.After(r)) }
 
-func FixMetricQuery(now time.Time, query MetricQuery) MetricQuery {
-	if query.EndTime == time.UnixMicro(0) {
+// ResolveMetricQuery replaces relative boundaries of the query with absolute ones at the given moment
+func ResolveMetricQuery(now time.Time, query MetricQuery) MetricQuery {
+	location := query.Location
+	if location == nil {
+		location = time.UTC
+	}
+	if query.From != nil {
+		query.StartTime = query.From.Resolve(now, location, false)
+	}
+	if query.To != nil {
+		query.EndTime = query.To.Resolve(now, location, true)
+	} else if query.EndTime == time.UnixMicro(0) {
 		query.EndTime = now
 	}
+	if query.MaxPoints > 0 {
+		query.Resolution = ChooseResolution(query.EndTime.Sub(query.StartTime), query.Resolution, query.MaxPoints)
+	}
+	query.From, query.To, query.Location, query.MaxPoints = nil, nil, nil, 0
+	return query
+}
+
+func FixMetricQuery(now time.Time, query MetricQuery) MetricQuery {
+	query = ResolveMetricQuery(now, query)
 	if query.StartTime.After(query.EndTime) {
 		query.EndTime = query.StartTime
 	}
 	return query
 }
 
-func AdjustMetricQuery(now time.Time, previous *MetricQuery, current MetricQuery) (*MetricQuery, MetricQuery) {
-	current = FixMetricQuery(now, current)
-	if previous == nil || current.Resolution != previous.Resolution || current.EndTime.Before(previous.StartTime) || current.StartTime.After(previous.EndTime) {
-		return &current, current
+// Interval is a closed time range with microsecond granularity
+type Interval struct {
+	Start time.Time
+	End   time.Time
+}
+
+// IntervalSet is a sorted list of disjoint intervals loaded with the same resolution
+type IntervalSet struct {
+	Resolution time.Duration
+	Intervals  []Interval
+}
+
+func NewIntervalSet(resolution time.Duration) *IntervalSet {
+	return &IntervalSet{Resolution: resolution}
+}
+
+func (s *IntervalSet) Clone() *IntervalSet {
+	return &IntervalSet{Resolution: s.Resolution, Intervals: append([]Interval(nil), s.Intervals...)}
+}
+
+// Add inserts interval into the set merging it with all overlapping and adjacent intervals
+func (s *IntervalSet) Add(interval Interval) {
+	if interval.End.Before(interval.Start) {
+		return
+	}
+	merged := make([]Interval, 0, len(s.Intervals)+1)
+	inserted := false
+	for _, current := range s.Intervals {
+		if current.End.Add(time.Microsecond).Before(interval.Start) {
+			merged = append(merged, current)
+		} else if interval.End.Add(time.Microsecond).Before(current.Start) {
+			if !inserted {
+				merged = append(merged, interval)
+				inserted = true
+			}
+			merged = append(merged, current)
+		} else {
+			if current.Start.Before(interval.Start) {
+				interval.Start = current.Start
+			}
+			if current.End.After(interval.End) {
+				interval.End = current.End
+			}
+		}
+	}
+	if !inserted {
+		merged = append(merged, interval)
 	}
-	// previous != nil && current.Resolution == previous.Resolution
-	if Within(current.StartTime, previous.StartTime, previous.EndTime) && Within(current.EndTime, previous.StartTime, previous.EndTime) {
-		return nil, *previous
+	s.Intervals = merged
+}
+
+// Missing returns all sub-ranges of the interval which are not covered by the set
+func (s *IntervalSet) Missing(interval Interval) []Interval {
+	missing := make([]Interval, 0)
+	start := interval.Start
+	for _, current := range s.Intervals {
+		if current.End.Before(start) {
+			continue
+		}
+		if current.Start.After(interval.End) {
+			break
+		}
+		if current.Start.After(start) {
+			missing = append(missing, Interval{Start: start, End: current.Start.Add(-time.Microsecond)})
+		}
+		start = current.End.Add(time.Microsecond)
 	}
-	fragmentQuery := current
-	fullQuery := current
-	if BeforeOrSame(previous.StartTime, current.StartTime) && AfterOrSame(previous.EndTime, current.StartTime) && previous.EndTime.Before(current.EndTime) {
-		fragmentQuery.StartTime = previous.EndTime
-		fullQuery.EndTime = current.EndTime
-	} else if BeforeOrSame(previous.StartTime, current.EndTime) && AfterOrSame(previous.EndTime, current.EndTime) && previous.StartTime.After(current.StartTime) {
-		fragmentQuery.EndTime = previous.StartTime
-		fullQuery.StartTime = current.StartTime
+	if !start.After(interval.End) {
+		missing = append(missing, Interval{Start: start, End: interval.End})
+	}
+	return missing
+}
+
+// ForgetAfter removes all points starting from the given time from the set
+func (s *IntervalSet) ForgetAfter(from time.Time) {
+	kept := make([]Interval, 0, len(s.Intervals))
+	for _, current := range s.Intervals {
+		if !current.Start.Before(from) {
+			break
+		}
+		if !current.End.Before(from) {
+			current.End = from.Add(-time.Microsecond)
+		}
+		kept = append(kept, current)
+	}
+	s.Intervals = kept
+}
+
+// MergeMode returns how points of the interval must be merged with points of the set on the client side
+func (s *IntervalSet) MergeMode(interval Interval) MergeMode {
+	if len(s.Intervals) == 0 || s.Intervals[len(s.Intervals)-1].End.Before(interval.Start) {
+		return AppendMergeMode
+	}
+	if interval.End.Before(s.Intervals[0].Start) {
+		return PrependMergeMode
+	}
+	return ReplaceMergeMode
+}
+
+// ForgetBefore removes all points preceding the given time from the set
+func (s *IntervalSet) ForgetBefore(before time.Time) {
+	kept := make([]Interval, 0, len(s.Intervals))
+	for _, current := range s.Intervals {
+		if current.End.Before(before) {
+			continue
+		}
+		if current.Start.Before(before) {
+			current.Start = before
+		}
+		kept = append(kept, current)
 	}
-	return &fragmentQuery, fullQuery
+	s.Intervals = kept
 }
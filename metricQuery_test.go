@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntervalSet(t *testing.T) {
+	at := func(us int64) time.Time { return time.UnixMicro(us) }
+	set := NewIntervalSet(time.Second)
+	set.Add(Interval{Start: at(10), End: at(20)})
+	set.Add(Interval{Start: at(40), End: at(50)})
+	set.Add(Interval{Start: at(21), End: at(25)})
+	require.Equal(t, []Interval{{Start: at(10), End: at(25)}, {Start: at(40), End: at(50)}}, set.Intervals)
+
+	require.Equal(t, []Interval{
+		{Start: at(0), End: at(9)},
+		{Start: at(26), End: at(39)},
+		{Start: at(51), End: at(60)},
+	}, set.Missing(Interval{Start: at(0), End: at(60)}))
+	require.Equal(t, []Interval{{Start: at(26), End: at(30)}}, set.Missing(Interval{Start: at(15), End: at(30)}))
+	require.Empty(t, set.Missing(Interval{Start: at(41), End: at(45)}))
+
+	clone := set.Clone()
+	clone.Add(Interval{Start: at(0), End: at(100)})
+	require.Equal(t, []Interval{{Start: at(0), End: at(100)}}, clone.Intervals)
+	require.Len(t, set.Intervals, 2)
+
+	require.Equal(t, PrependMergeMode, set.MergeMode(Interval{Start: at(0), End: at(9)}))
+	require.Equal(t, AppendMergeMode, set.MergeMode(Interval{Start: at(51), End: at(60)}))
+	require.Equal(t, ReplaceMergeMode, set.MergeMode(Interval{Start: at(26), End: at(39)}))
+	require.Equal(t, AppendMergeMode, NewIntervalSet(time.Second).MergeMode(Interval{Start: at(0), End: at(9)}))
+
+	set.ForgetAfter(at(45))
+	require.Equal(t, []Interval{{Start: at(10), End: at(25)}, {Start: at(40), End: at(44)}}, set.Intervals)
+	set.ForgetAfter(at(30))
+	require.Equal(t, []Interval{{Start: at(10), End: at(25)}}, set.Intervals)
+	set.ForgetBefore(at(20))
+	require.Equal(t, []Interval{{Start: at(20), End: at(25)}}, set.Intervals)
+	set.ForgetBefore(at(26))
+	require.Empty(t, set.Intervals)
+}
+
+func TestChooseResolution(t *testing.T) {
+	require.Equal(t, 10*time.Second, ChooseResolution(59*time.Second, 0, 10))
+	require.Equal(t, 7*time.Second, ChooseResolution(time.Minute, 7*time.Second, 10))
+	require.Equal(t, 10*time.Second, ChooseResolution(time.Minute, 3*time.Second, 10))
+	require.Equal(t, time.Millisecond, ChooseResolution(time.Minute, time.Microsecond, MaxPanelDataPoints))
+
+	var command MetricBoardTimeUpdateCommand
+	require.Nil(t, json.Unmarshal([]byte(`{"start": 1000000, "end": 61000000, "resolution": "auto", "maxPoints": 10}`), &command))
+	query, err := ParseTimeUpdate(command)
+	require.Nil(t, err)
+	require.Equal(t, 10*time.Second, ResolveMetricQuery(time.Now(), query).Resolution)
+
+	command = MetricBoardTimeUpdateCommand{}
+	require.Nil(t, json.Unmarshal([]byte(`{"start": 1000000, "end": 61000000, "resolution": 1}`), &command))
+	query, err = ParseTimeUpdate(command)
+	require.Nil(t, err)
+	require.Equal(t, time.Millisecond, ResolveMetricQuery(time.Now(), query).Resolution)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ValidatePanelTransforms checks that transforms configured for the panel are known
+func ValidatePanelTransforms(panel Panel) error {
+	switch panel.Downsample {
+	case "", AvgDownsample, MinDownsample, MaxDownsample, LastDownsample, LttbDownsample:
+	default:
+		return fmt.Errorf("unknown downsample mode: %v", panel.Downsample)
+	}
+	if panel.Transform != "" {
+		if _, err := NewCounterTransform(panel.Transform); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TransformMetric applies transforms configured for the panel to the instance metric loaded with the resolution
+func TransformMetric(panel Panel, resolution time.Duration, metric Metric) []Metric {
+	if metric.Type != InstanceMetricLineType || len(metric.Timestamps) == 0 {
+		return []Metric{metric}
+	}
+	transformed := make([]Metric, 0, 3)
+	if panel.Envelope {
+		lower, upper := MetricEnvelope(metric, resolution)
+		transformed = append(transformed, lower, upper)
+	}
+	switch panel.Downsample {
+	case "":
+	case LttbDownsample:
+		buckets := int((metric.Timestamps[len(metric.Timestamps)-1]-metric.Timestamps[0])/uint64(resolution.Microseconds())) + 1
+		metric.Timestamps, metric.Values = LTTB(metric.Timestamps, metric.Values, buckets)
+	default:
+		if Crowded(metric, resolution) {
+			metric = DownsampleMetric(metric, resolution, panel.Downsample)
+		}
+	}
+	return append([]Metric{metric}, transformed...)
+}
+
+type panelTransformDataSource struct {
+	dataSource DataSource
+	panels     PanelProvider
+}
+
+type streamingPanelTransformDataSource struct {
+	panelTransformDataSource
+	streamingDataSource StreamingDataSource
+}
+
+// WithPanelTransforms returns DataSource which applies transforms configured for the panel to every metric of the data source
+func WithPanelTransforms(dataSource DataSource, panels PanelProvider) DataSource {
+	transforms := panelTransformDataSource{dataSource: dataSource, panels: panels}
+	if streamingDataSource, ok := dataSource.(StreamingDataSource); ok {
+		return streamingPanelTransformDataSource{panelTransformDataSource: transforms, streamingDataSource: streamingDataSource}
+	}
+	return transforms
+}
+
+// transform applies panel transforms to the produced metrics; points preceding from are used only as predecessors for the counter transform
+func (s panelTransformDataSource) transform(
+	ctx context.Context,
+	panelId string,
+	resolution time.Duration,
+	from time.Time,
+	metrics chan<- Metric,
+	produce func(panel Panel, metrics chan<- Metric) error,
+) error {
+	panel, err := s.panels.GetPanel(ctx, panelId)
+	if err != nil {
+		return fmt.Errorf("failed to get panel: id=%v, err=%w", panelId, err)
+	}
+	if panel.Transform == "" && panel.Downsample == "" && !panel.Envelope {
+		return produce(panel, metrics)
+	}
+	var counter *CounterTransform
+	if panel.Transform != "" {
+		if counter, err = NewCounterTransform(panel.Transform); err != nil {
+			return err
+		}
+	}
+	return ConsumeStream(func(inner chan<- Metric) error {
+		return produce(panel, inner)
+	}, func(metric Metric) {
+		if counter != nil && metric.Type == InstanceMetricLineType {
+			metric = counter.Apply(metric)
+			skip := sort.Search(len(metric.Timestamps), func(i int) bool { return metric.Timestamps[i] >= uint64(from.UnixMicro()) })
+			metric.Timestamps, metric.Values = metric.Timestamps[skip:], metric.Values[skip:]
+			if len(metric.Timestamps) == 0 {
+				return
+			}
+		}
+		for _, transformed := range TransformMetric(panel, resolution, metric) {
+			select {
+			case <-ctx.Done():
+			case metrics <- transformed:
+			}
+		}
+	})
+}
+
+func (s panelTransformDataSource) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
+	return s.transform(ctx, panelId, query.Resolution, query.StartTime, metrics, func(panel Panel, inner chan<- Metric) error {
+		if panel.Transform != "" {
+			// look one bucket back in order to have predecessor for the first point of the query
+			query.StartTime = query.StartTime.Add(-query.Resolution)
+		}
+		return s.dataSource.GetMetric(ctx, panelId, query, inner)
+	})
+}
+
+func (s streamingPanelTransformDataSource) Subscribe(ctx context.Context, panelId string, from time.Time, resolution time.Duration, metrics chan<- Metric) error {
+	return s.transform(ctx, panelId, resolution, from, metrics, func(panel Panel, inner chan<- Metric) error {
+		return s.streamingDataSource.Subscribe(ctx, panelId, from, resolution, inner)
+	})
+}
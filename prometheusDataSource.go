@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type prometheusSample [2]any
+
+type prometheusSeries struct {
+	Metric map[string]string  `json:"metric"`
+	Values []prometheusSample `json:"values"`
+}
+
+type prometheusResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string             `json:"resultType"`
+		Result     []prometheusSeries `json:"result"`
+	} `json:"data"`
+}
+
+// PrometheusDataSource executes PromQL expression from Panel.Query against Prometheus query_range HTTP API
+type PrometheusDataSource struct {
+	url    string
+	client *http.Client
+	panels PanelProvider
+}
+
+func NewPrometheusDataSource(url string, panels PanelProvider) *PrometheusDataSource {
+	return &PrometheusDataSource{url: strings.TrimSuffix(url, "/"), client: http.DefaultClient, panels: panels}
+}
+
+func formatPrometheusTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMicro())/1e6, 'f', -1, 64)
+}
+
+func (p *PrometheusDataSource) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
+	panel, err := p.panels.GetPanel(ctx, panelId)
+	if err != nil {
+		return err
+	}
+	if panel.Query == "" {
+		return fmt.Errorf("empty prometheus query for panel: id=%v", panelId)
+	}
+	params := url.Values{}
+	params.Set("query", SubstituteVariables(panel.Query, query.Variables))
+	params.Set("start", formatPrometheusTime(query.StartTime))
+	params.Set("end", formatPrometheusTime(query.EndTime))
+	params.Set("step", strconv.FormatFloat(query.Resolution.Seconds(), 'f', -1, 64))
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+"/api/v1/query_range", strings.NewReader(params.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create prometheus request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := p.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("prometheus request failed: %w", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read prometheus response: %w", err)
+	}
+	var result prometheusResponse
+	if err = json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to parse prometheus response: status=%v, err=%w", response.StatusCode, err)
+	}
+	if result.Status != "success" {
+		return fmt.Errorf("prometheus query failed: type=%v, err=%v", result.ErrorType, result.Error)
+	}
+	if result.Data.ResultType != "matrix" {
+		return fmt.Errorf("unexpected prometheus result type: %v", result.Data.ResultType)
+	}
+	for _, series := range result.Data.Result {
+		metric, err := parsePrometheusSeries(panelId, series)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case metrics <- metric:
+		}
+	}
+	return nil
+}
+
+func parsePrometheusSeries(panelId string, series prometheusSeries) (Metric, error) {
+	metric := Metric{
+		PanelId:    panelId,
+		Type:       InstanceMetricLineType,
+		Labels:     series.Metric,
+		Timestamps: make([]uint64, 0, len(series.Values)),
+		Values:     make([]float32, 0, len(series.Values)),
+	}
+	for _, sample := range series.Values {
+		timestamp, ok := sample[0].(float64)
+		if !ok {
+			return Metric{}, fmt.Errorf("unexpected prometheus timestamp: %v", sample[0])
+		}
+		raw, ok := sample[1].(string)
+		if !ok {
+			return Metric{}, fmt.Errorf("unexpected prometheus value: %v", sample[1])
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return Metric{}, fmt.Errorf("unexpected prometheus value: %v", raw)
+		}
+		metric.Timestamps = append(metric.Timestamps, uint64(math.Round(timestamp*1e6)))
+		metric.Values = append(metric.Values, float32(value))
+	}
+	return metric, nil
+}
+
+type prometheusListResponse struct {
+	Status    string   `json:"status"`
+	ErrorType string   `json:"errorType"`
+	Error     string   `json:"error"`
+	Data      []string `json:"data"`
+}
+
+// list requests one of the Prometheus metadata endpoints which respond with the list of strings
+func (p *PrometheusDataSource) list(ctx context.Context, path string, metric string, prefix string) ([]string, error) {
+	params := url.Values{}
+	if metric != "" {
+		params.Set("match[]", metric)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create prometheus request: %w", err)
+	}
+	response, err := p.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("prometheus request failed: %w", err)
+	}
+	defer response.Body.Close()
+	var result prometheusListResponse
+	if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse prometheus response: status=%v, err=%w", response.StatusCode, err)
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("prometheus request failed: type=%v, err=%v", result.ErrorType, result.Error)
+	}
+	return CatalogEntries(result.Data, prefix), nil
+}
+
+func (p *PrometheusDataSource) MetricNames(ctx context.Context, prefix string) ([]string, error) {
+	return p.list(ctx, "/api/v1/label/__name__/values", "", prefix)
+}
+
+func (p *PrometheusDataSource) LabelKeys(ctx context.Context, metric string, prefix string) ([]string, error) {
+	return p.list(ctx, "/api/v1/labels", metric, prefix)
+}
+
+func (p *PrometheusDataSource) LabelValues(ctx context.Context, metric string, label string, prefix string) ([]string, error) {
+	return p.list(ctx, "/api/v1/label/"+url.PathEscape(label)+"/values", metric, prefix)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type staticPanels map[string]Panel
+
+func (p staticPanels) GetPanel(ctx context.Context, panelId string) (Panel, error) {
+	return p[panelId], nil
+}
+
+func TestPrometheusDataSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		require.Equal(t, "/api/v1/query_range", request.URL.Path)
+		require.Nil(t, request.ParseForm())
+		require.Equal(t, "rate(requests_total[1m])", request.Form.Get("query"))
+		require.Equal(t, "1700000000", request.Form.Get("start"))
+		require.Equal(t, "1700000060.5", request.Form.Get("end"))
+		require.Equal(t, "30", request.Form.Get("step"))
+		_, _ = writer.Write([]byte(`{"status": "success", "data": {"resultType": "matrix", "result": [
+			{"metric": {"host": "a"}, "values": [[1700000000, "1"], [1700000030, "2.5"]]},
+			{"metric": {"host": "b"}, "values": [[1700000000.25, "NaN"]]}
+		]}}`))
+	}))
+	defer server.Close()
+
+	dataSource := NewPrometheusDataSource(server.URL, staticPanels{"p-1": {Id: "p-1", Query: "rate(requests_total[1m])"}})
+	metrics := make(chan Metric, 2)
+	err := dataSource.GetMetric(context.Background(), "p-1", MetricQuery{
+		StartTime:  time.Unix(1700000000, 0),
+		EndTime:    time.Unix(1700000060, 500_000_000),
+		Resolution: 30 * time.Second,
+	}, metrics)
+	require.Nil(t, err)
+	a, b := <-metrics, <-metrics
+	require.Equal(t, map[string]string{"host": "a"}, a.Labels)
+	require.Equal(t, []uint64{1700000000_000000, 1700000030_000000}, a.Timestamps)
+	require.Equal(t, []float32{1, 2.5}, a.Values)
+	require.Equal(t, InstanceMetricLineType, a.Type)
+	require.Equal(t, map[string]string{"host": "b"}, b.Labels)
+	require.Equal(t, []uint64{1700000000_250000}, b.Timestamps)
+
+	require.NotNil(t, dataSource.GetMetric(context.Background(), "p-2", MetricQuery{}, metrics))
+}
+
+func TestPrometheusCatalog(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/api/v1/label/__name__/values":
+			require.Empty(t, request.URL.Query()["match[]"])
+			_, _ = writer.Write([]byte(`{"status": "success", "data": ["requests_total", "errors_total", "requests_duration"]}`))
+		case "/api/v1/labels":
+			require.Equal(t, "requests_total", request.URL.Query().Get("match[]"))
+			_, _ = writer.Write([]byte(`{"status": "success", "data": ["__name__", "host", "cluster"]}`))
+		default:
+			_, _ = writer.Write([]byte(`{"status": "error", "errorType": "bad_data", "error": "unknown label"}`))
+		}
+	}))
+	defer server.Close()
+
+	dataSource := NewPrometheusDataSource(server.URL, staticPanels{})
+	names, err := dataSource.MetricNames(context.Background(), "requests")
+	require.Nil(t, err)
+	require.Equal(t, []string{"requests_duration", "requests_total"}, names)
+	keys, err := dataSource.LabelKeys(context.Background(), "requests_total", "")
+	require.Nil(t, err)
+	require.Equal(t, []string{"__name__", "cluster", "host"}, keys)
+	_, err = dataSource.LabelValues(context.Background(), "", "host", "")
+	require.NotNil(t, err)
+}
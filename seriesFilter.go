@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	EqualLabelMatcher    = "="
+	NotEqualLabelMatcher = "!="
+	RegexLabelMatcher    = "=~"
+	NotRegexLabelMatcher = "!~"
+)
+
+const (
+	SumTopKReducer     = "sum"
+	DefaultTopKReducer = MaxDownsample
+)
+
+type LabelMatcher struct {
+	Label string `json:"label"`
+	Op    string `json:"op,omitempty"` // =, !=, =~ or !~; missing label is treated as an empty value
+	Value string `json:"value"`
+}
+
+// PanelFilter selects series of the panel on the server before they are sent to the client
+type PanelFilter struct {
+	Matchers []LabelMatcher `json:"matchers,omitempty"`
+	TopK     int            `json:"topk,omitempty"`    // keep only k series with the largest reduced value
+	Reducer  string         `json:"reducer,omitempty"` // avg, min, max (default), last or sum of the series values
+}
+
+type labelMatcher struct {
+	LabelMatcher
+	regex *regexp.Regexp
+}
+
+func (m labelMatcher) matches(labels map[string]string) bool {
+	value := labels[m.Label]
+	switch m.Op {
+	case NotEqualLabelMatcher:
+		return value != m.Value
+	case RegexLabelMatcher:
+		return m.regex.MatchString(value)
+	case NotRegexLabelMatcher:
+		return !m.regex.MatchString(value)
+	}
+	return value == m.Value
+}
+
+// SeriesFilter applies PanelFilter to the series of the panel. Top series are selected once by the first filtered
+// query and then kept for all subsequent queries and subscriptions of the panel, so that incremental fragments
+// never replace series which were already sent
+type SeriesFilter struct {
+	matchers []labelMatcher
+	topK     int
+	reducer  string
+
+	lock     sync.Mutex
+	selected map[string]bool // identities of the top series; nil until the first selection
+}
+
+func NewSeriesFilter(filter PanelFilter) (*SeriesFilter, error) {
+	if filter.TopK < 0 {
+		return nil, fmt.Errorf("negative topk: %v", filter.TopK)
+	}
+	reducer := filter.Reducer
+	switch reducer {
+	case "":
+		reducer = DefaultTopKReducer
+	case AvgDownsample, MinDownsample, MaxDownsample, LastDownsample, SumTopKReducer:
+	default:
+		return nil, fmt.Errorf("unknown topk reducer: %v", filter.Reducer)
+	}
+	matchers := make([]labelMatcher, 0, len(filter.Matchers))
+	for _, matcher := range filter.Matchers {
+		compiled := labelMatcher{LabelMatcher: matcher}
+		switch matcher.Op {
+		case "":
+			compiled.Op = EqualLabelMatcher
+		case EqualLabelMatcher, NotEqualLabelMatcher:
+		case RegexLabelMatcher, NotRegexLabelMatcher:
+			regex, err := regexp.Compile("^(?:" + matcher.Value + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid label matcher regex: label=%v, err=%w", matcher.Label, err)
+			}
+			compiled.regex = regex
+		default:
+			return nil, fmt.Errorf("unknown label matcher: label=%v, op=%v", matcher.Label, matcher.Op)
+		}
+		matchers = append(matchers, compiled)
+	}
+	return &SeriesFilter{matchers: matchers, topK: filter.TopK, reducer: reducer}, nil
+}
+
+// NewSeriesFilters compiles filters of the panels; panels with empty filter are mapped to nil
+func NewSeriesFilters(filters map[string]PanelFilter) (map[string]*SeriesFilter, error) {
+	compiled := make(map[string]*SeriesFilter, len(filters))
+	for panelId, filter := range filters {
+		if len(filter.Matchers) == 0 && filter.TopK == 0 {
+			compiled[panelId] = nil
+			continue
+		}
+		seriesFilter, err := NewSeriesFilter(filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid panel filter: id=%v, err=%w", panelId, err)
+		}
+		compiled[panelId] = seriesFilter
+	}
+	return compiled, nil
+}
+
+// Unselected returns filter with the same matchers which selects top series again by the next query.
+// Queries which are still in flight keep using the original filter, so they can't affect the new selection
+func (f *SeriesFilter) Unselected() *SeriesFilter {
+	return &SeriesFilter{matchers: f.matchers, topK: f.topK, reducer: f.reducer}
+}
+
+// seriesIdentity identifies the series regardless of the line type, so envelope lines follow their instance line
+func seriesIdentity(metric Metric) string {
+	return metric.Group + "|" + LabelsKey(metric.Labels)
+}
+
+func (f *SeriesFilter) matches(metric Metric) bool {
+	for _, matcher := range f.matchers {
+		if !matcher.matches(metric.Labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Accept returns true if the metric matches all label matchers and belongs to the top series (if they were already selected)
+func (f *SeriesFilter) Accept(metric Metric) bool {
+	if !f.matches(metric) {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.selected == nil || f.selected[seriesIdentity(metric)]
+}
+
+func (f *SeriesFilter) reduce(metric Metric) float64 {
+	reduced, count := 0.0, 0
+	for _, value := range metric.Values {
+		if math.IsNaN(float64(value)) {
+			continue
+		}
+		switch {
+		case count == 0 || f.reducer == LastDownsample:
+			reduced = float64(value)
+		case f.reducer == MinDownsample:
+			reduced = math.Min(reduced, float64(value))
+		case f.reducer == MaxDownsample:
+			reduced = math.Max(reduced, float64(value))
+		default:
+			reduced += float64(value)
+		}
+		count++
+	}
+	if count == 0 {
+		return math.Inf(-1)
+	}
+	if f.reducer == AvgDownsample {
+		return reduced / float64(count)
+	}
+	return reduced
+}
+
+// Filter drops metrics which don't match label matchers and keeps only top series among instance lines
+func (f *SeriesFilter) Filter(metrics []Metric) []Metric {
+	matched := make([]Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		if f.matches(metric) {
+			matched = append(matched, metric)
+		}
+	}
+	if f.topK == 0 {
+		return matched
+	}
+	f.lock.Lock()
+	if f.selected == nil {
+		instances := make([]Metric, 0)
+		for _, metric := range matched {
+			if metric.Type == InstanceMetricLineType {
+				instances = append(instances, metric)
+			}
+		}
+		// query without series doesn't fix the selection, so series which appear later can still be chosen
+		if len(instances) > 0 {
+			sort.SliceStable(instances, func(i, j int) bool { return f.reduce(instances[i]) > f.reduce(instances[j]) })
+			f.selected = make(map[string]bool)
+			for _, metric := range instances[:min(f.topK, len(instances))] {
+				f.selected[seriesIdentity(metric)] = true
+			}
+		}
+	}
+	f.lock.Unlock()
+	filtered := make([]Metric, 0, len(matched))
+	for _, metric := range matched {
+		if f.Accept(metric) {
+			filtered = append(filtered, metric)
+		}
+	}
+	return filtered
+}
+
+type filteredDataSource struct {
+	dataSource DataSource
+	filter     func(panelId string) *SeriesFilter
+}
+
+type streamingFilteredDataSource struct {
+	filteredDataSource
+	streamingDataSource StreamingDataSource
+}
+
+// WithSeriesFilters returns DataSource which applies filter of the panel (if any) to the metrics of the data source
+func WithSeriesFilters(dataSource DataSource, filter func(panelId string) *SeriesFilter) DataSource {
+	filtered := filteredDataSource{dataSource: dataSource, filter: filter}
+	if streamingDataSource, ok := dataSource.(StreamingDataSource); ok {
+		return streamingFilteredDataSource{filteredDataSource: filtered, streamingDataSource: streamingDataSource}
+	}
+	return filtered
+}
+
+func (s filteredDataSource) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
+	filter := s.filter(panelId)
+	if filter == nil {
+		return s.dataSource.GetMetric(ctx, panelId, query, metrics)
+	}
+	// all series of the query are needed in order to choose the top ones
+	buffered := make([]Metric, 0)
+	err := ConsumeStream(func(inner chan<- Metric) error {
+		return s.dataSource.GetMetric(ctx, panelId, query, inner)
+	}, func(metric Metric) {
+		buffered = append(buffered, metric)
+	})
+	if err != nil {
+		return err
+	}
+	for _, metric := range filter.Filter(buffered) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case metrics <- metric:
+		}
+	}
+	return nil
+}
+
+// Subscribe pushes only metrics accepted by the current filter of the panel; top series are never selected by pushes
+func (s streamingFilteredDataSource) Subscribe(ctx context.Context, panelId string, from time.Time, resolution time.Duration, metrics chan<- Metric) error {
+	return ConsumeStream(func(inner chan<- Metric) error {
+		return s.streamingDataSource.Subscribe(ctx, panelId, from, resolution, inner)
+	}, func(metric Metric) {
+		if filter := s.filter(panelId); filter != nil && !filter.Accept(metric) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case metrics <- metric:
+		}
+	})
+}
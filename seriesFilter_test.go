@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeriesFilter(t *testing.T) {
+	series := func(host, zone string, values ...float32) Metric {
+		timestamps := make([]uint64, len(values))
+		for i := range timestamps {
+			timestamps[i] = uint64(i)
+		}
+		return Metric{Type: InstanceMetricLineType, Labels: map[string]string{"host": host, "zone": zone}, Timestamps: timestamps, Values: values}
+	}
+	hosts := func(metrics []Metric) []string {
+		names := make([]string, 0)
+		for _, metric := range metrics {
+			names = append(names, metric.Labels["host"])
+		}
+		return names
+	}
+	metrics := []Metric{series("a-1", "x", 1, 9), series("a-2", "y", 5, 5), series("b-1", "x", 7, 2), series("c-1", "", 3, 3)}
+
+	filter, err := NewSeriesFilter(PanelFilter{Matchers: []LabelMatcher{{Label: "host", Op: "=~", Value: "a-.*|b-1"}, {Label: "zone", Op: "!=", Value: "y"}}})
+	require.Nil(t, err)
+	require.Equal(t, []string{"a-1", "b-1"}, hosts(filter.Filter(metrics)))
+
+	filter, err = NewSeriesFilter(PanelFilter{Matchers: []LabelMatcher{{Label: "zone", Value: ""}}})
+	require.Nil(t, err)
+	require.Equal(t, []string{"c-1"}, hosts(filter.Filter(metrics)))
+
+	filter, err = NewSeriesFilter(PanelFilter{Matchers: []LabelMatcher{{Label: "host", Op: "!~", Value: "b-.*"}}, TopK: 2, Reducer: "avg"})
+	require.Nil(t, err)
+	require.Empty(t, filter.Filter(nil))
+	require.Equal(t, []string{"a-1", "a-2"}, hosts(filter.Filter(metrics)))
+	// selection is kept for subsequent queries even if ranking changes
+	require.Equal(t, []string{"a-1"}, hosts(filter.Filter([]Metric{series("a-1", "x", 0), series("c-1", "", 100)})))
+	require.True(t, filter.Accept(Metric{Type: EnvelopeMaxMetricLineType, Labels: map[string]string{"host": "a-2", "zone": "y"}}))
+	require.False(t, filter.Accept(series("c-1", "")))
+	require.False(t, filter.Accept(series("b-1", "x")))
+	require.Equal(t, []string{"a-1", "c-1"}, hosts(filter.Unselected().Filter([]Metric{series("a-1", "x", 0), series("a-2", "y", -1), series("c-1", "", 100)})))
+
+	filter, err = NewSeriesFilter(PanelFilter{TopK: 1, Reducer: "min"})
+	require.Nil(t, err)
+	require.Equal(t, []string{"a-2"}, hosts(filter.Filter(metrics)))
+
+	for _, invalid := range []PanelFilter{
+		{TopK: -1},
+		{TopK: 1, Reducer: "median"},
+		{Matchers: []LabelMatcher{{Label: "host", Op: "~", Value: "a"}}},
+		{Matchers: []LabelMatcher{{Label: "host", Op: "=~", Value: "("}}},
+	} {
+		_, err := NewSeriesFilter(invalid)
+		require.NotNil(t, err)
+	}
+	filters, err := NewSeriesFilters(map[string]PanelFilter{"p": {}})
+	require.Nil(t, err)
+	require.Equal(t, map[string]*SeriesFilter{"p": nil}, filters)
+
+	dataSource := WithSeriesFilters(staticDataSource(metrics), func(panelId string) *SeriesFilter {
+		filter, _ := NewSeriesFilter(PanelFilter{TopK: 1})
+		return filter
+	})
+	filtered := make(chan Metric, 4)
+	require.Nil(t, dataSource.GetMetric(context.Background(), "p", MetricQuery{}, filtered))
+	require.Len(t, filtered, 1)
+	require.Equal(t, "a-1", (<-filtered).Labels["host"])
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SqlPlaceholderStyle int
+
+const (
+	QuestionSqlPlaceholder SqlPlaceholderStyle = iota + 1 // ? (sqlite, mysql, clickhouse)
+	DollarSqlPlaceholder                                  // $1, $2, ... (postgres)
+)
+
+const (
+	SqlTimestampColumn = "timestamp"
+	SqlValueColumn     = "value"
+	SqlGroupColumn     = "group"
+)
+
+var sqlTemplateVariable = regexp.MustCompile(`\$([a-zA-Z_][a-zA-Z0-9_]*)\b`)
+
+// SqlDataSource executes SQL query template from Panel.Query with $start, $end and $resolution variables
+// bound as query parameters (microseconds). Dashboard variables are bound as string parameters as well.
+// Query must return timestamp and value columns, optional group column and all other columns are treated as labels
+type SqlDataSource struct {
+	db          *sql.DB
+	placeholder SqlPlaceholderStyle
+	panels      PanelProvider
+}
+
+func NewSqlDataSource(db *sql.DB, placeholder SqlPlaceholderStyle, panels PanelProvider) *SqlDataSource {
+	return &SqlDataSource{db: db, placeholder: placeholder, panels: panels}
+}
+
+// BindSqlTemplate replaces template variables with driver-specific positional placeholders and returns matching arguments
+func BindSqlTemplate(template string, placeholder SqlPlaceholderStyle, query MetricQuery) (string, []any) {
+	args := make([]any, 0)
+	statement := sqlTemplateVariable.ReplaceAllStringFunc(template, func(variable string) string {
+		switch variable {
+		case "$start":
+			args = append(args, query.StartTime.UnixMicro())
+		case "$end":
+			args = append(args, query.EndTime.UnixMicro())
+		case "$resolution":
+			args = append(args, query.Resolution.Microseconds())
+		default:
+			value, ok := query.Variables[variable[1:]]
+			if !ok {
+				return variable
+			}
+			args = append(args, value)
+		}
+		if placeholder == DollarSqlPlaceholder {
+			return "$" + strconv.Itoa(len(args))
+		}
+		return "?"
+	})
+	return statement, args
+}
+
+func (s *SqlDataSource) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
+	panel, err := s.panels.GetPanel(ctx, panelId)
+	if err != nil {
+		return err
+	}
+	if panel.Query == "" {
+		return fmt.Errorf("empty sql query for panel: id=%v", panelId)
+	}
+	statement, args := BindSqlTemplate(panel.Query, s.placeholder, query)
+	rows, err := s.db.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return fmt.Errorf("sql query failed: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("failed to get sql columns: %w", err)
+	}
+	timestampColumn, valueColumn, groupColumn := -1, -1, -1
+	for i, column := range columns {
+		switch strings.ToLower(column) {
+		case SqlTimestampColumn:
+			timestampColumn = i
+		case SqlValueColumn:
+			valueColumn = i
+		case SqlGroupColumn:
+			groupColumn = i
+		}
+	}
+	if timestampColumn == -1 || valueColumn == -1 {
+		return fmt.Errorf("sql query must return %v and %v columns: columns=%v", SqlTimestampColumn, SqlValueColumn, columns)
+	}
+
+	series := make(map[string]*Metric)
+	keys := make([]string, 0)
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			return fmt.Errorf("failed to scan sql row: %w", err)
+		}
+		if values[valueColumn] == nil {
+			continue
+		}
+		timestamp, err := sqlTimestamp(values[timestampColumn])
+		if err != nil {
+			return err
+		}
+		value, err := sqlFloat(values[valueColumn])
+		if err != nil {
+			return err
+		}
+		group := ""
+		if groupColumn != -1 {
+			group = sqlString(values[groupColumn])
+		}
+		labels := make(map[string]string)
+		for i, column := range columns {
+			if i != timestampColumn && i != valueColumn && i != groupColumn {
+				labels[column] = sqlString(values[i])
+			}
+		}
+		key := group + "|" + LabelsKey(labels)
+		metric, ok := series[key]
+		if !ok {
+			metric = &Metric{PanelId: panelId, Type: InstanceMetricLineType, Group: group, Labels: labels}
+			series[key] = metric
+			keys = append(keys, key)
+		}
+		metric.Timestamps = append(metric.Timestamps, timestamp)
+		metric.Values = append(metric.Values, float32(value))
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate sql rows: %w", err)
+	}
+	for _, key := range keys {
+		metric := series[key]
+		sort.Sort(metricByTimestamp(*metric))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case metrics <- *metric:
+		}
+	}
+	return nil
+}
+
+type metricByTimestamp Metric
+
+func (m metricByTimestamp) Len() int           { return len(m.Timestamps) }
+func (m metricByTimestamp) Less(i, j int) bool { return m.Timestamps[i] < m.Timestamps[j] }
+func (m metricByTimestamp) Swap(i, j int) {
+	m.Timestamps[i], m.Timestamps[j] = m.Timestamps[j], m.Timestamps[i]
+	m.Values[i], m.Values[j] = m.Values[j], m.Values[i]
+}
+
+func sqlTimestamp(value any) (uint64, error) {
+	switch v := value.(type) {
+	case int64:
+		return uint64(v), nil
+	case float64:
+		return uint64(v), nil
+	case time.Time:
+		return uint64(v.UnixMicro()), nil
+	case []byte:
+		return sqlTimestamp(string(v))
+	case string:
+		if parsed, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return uint64(parsed), nil
+		}
+		if parsed, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return uint64(parsed.UnixMicro()), nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported sql timestamp value: %v (%T)", value, value)
+}
+
+func sqlFloat(value any) (float64, error) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case []byte:
+		return sqlFloat(string(v))
+	case string:
+		if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+			return parsed, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported sql value: %v (%T)", value, value)
+}
+
+func sqlString(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return fmt.Sprint(value)
+}
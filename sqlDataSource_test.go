@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSqlDataSource(t *testing.T) {
+	t.Run("bind", func(t *testing.T) {
+		query := MetricQuery{StartTime: time.UnixMicro(10), EndTime: time.UnixMicro(20), Resolution: 5 * time.Microsecond}
+		statement, args := BindSqlTemplate("select $start, $end, $resolution, $start_time, $end", DollarSqlPlaceholder, query)
+		require.Equal(t, "select $1, $2, $3, $start_time, $4", statement)
+		require.Equal(t, []any{int64(10), int64(20), int64(5), int64(20)}, args)
+		statement, _ = BindSqlTemplate("select $start, $end", QuestionSqlPlaceholder, query)
+		require.Equal(t, "select ?, ?", statement)
+		query.Variables = map[string]string{"host": "a"}
+		statement, args = BindSqlTemplate("select $start where host = $host and cluster = $cluster", QuestionSqlPlaceholder, query)
+		require.Equal(t, "select ? where host = ? and cluster = $cluster", statement)
+		require.Equal(t, []any{int64(10), "a"}, args)
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		db, err := sql.Open("sqlite", ":memory:")
+		require.Nil(t, err)
+		defer db.Close()
+		db.SetMaxOpenConns(1)
+		_, err = db.Exec(`create table samples (ts integer, host text, cluster text, value real)`)
+		require.Nil(t, err)
+		_, err = db.Exec(`insert into samples values (3000, 'a', 'x', 3), (1000, 'a', 'x', 1), (2000, 'b', 'x', 2), (2000, 'a', 'x', null), (9000, 'a', 'x', 9)`)
+		require.Nil(t, err)
+
+		dataSource := NewSqlDataSource(db, QuestionSqlPlaceholder, staticPanels{"p-1": {
+			Id:    "p-1",
+			Query: `select ts - ts % $resolution as timestamp, host, cluster as "group", value from samples where ts >= $start and ts <= $end`,
+		}})
+		metrics := make(chan Metric, 2)
+		require.Nil(t, dataSource.GetMetric(context.Background(), "p-1", MetricQuery{
+			StartTime:  time.UnixMicro(0),
+			EndTime:    time.UnixMicro(5000),
+			Resolution: time.Millisecond,
+		}, metrics))
+		require.Len(t, metrics, 2)
+		for i := 0; i < 2; i++ {
+			metric := <-metrics
+			require.Equal(t, "x", metric.Group)
+			switch metric.Labels["host"] {
+			case "a":
+				require.Equal(t, []uint64{1000, 3000}, metric.Timestamps)
+				require.Equal(t, []float32{1, 3}, metric.Values)
+			case "b":
+				require.Equal(t, []uint64{2000}, metric.Timestamps)
+				require.Equal(t, []float32{2}, metric.Values)
+			default:
+				t.Fatalf("unexpected labels: %v", metric.Labels)
+			}
+		}
+	})
+}
@@ -2,8 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,74 +23,303 @@ type Metric struct {
 	Values     []float32
 }
 
+// Key returns identifier of the metric series which is unique within the panel
+func (m Metric) Key() string {
+	return m.Type.String() + "|" + m.Group + "|" + LabelsKey(m.Labels)
+}
+
+// LabelsKey returns canonical representation of labels set which can be used as a map key
+func LabelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var builder strings.Builder
+	for i, key := range keys {
+		if i > 0 {
+			builder.WriteString(",")
+		}
+		builder.WriteString(strconv.Quote(key))
+		builder.WriteString("=")
+		builder.WriteString(strconv.Quote(labels[key]))
+	}
+	return builder.String()
+}
+
 type MetricResult struct {
-	PanelId string
-	Metric  Metric
-	Err     error
+	RequestId string
+	PanelId   string
+	Metric    Metric
+	Err       error
+	Complete  bool
+	Cancelled bool
+	// Mode describes how metric points must be merged with previously sent points of the series within Covered range
+	Mode    MergeMode
+	Covered Interval
+	// TrimBefore is set if points of the metric series before this time fell out of the sliding window
+	TrimBefore time.Time
+	Resolution time.Duration
+}
+
+// StreamingDataSource pushes new points of the panel starting from the given time as soon as they arrive.
+// Pushed points replace previously sent points of the same buckets, so the last bucket can be pushed again with
+// the value recomputed over all its samples. Subscribe blocks until context cancellation or failure
+type StreamingDataSource interface {
+	DataSource
+	Subscribe(ctx context.Context, panelId string, from time.Time, resolution time.Duration, metrics chan<- Metric) error
+}
+
+func panelPriority(visiblePanelIds []string, panelId string) int {
+	if slices.Contains(visiblePanelIds, panelId) {
+		return VisiblePanelPriority
+	}
+	return HiddenPanelPriority
+}
+
+type subscription struct {
+	resolution time.Duration
+	cancel     func()
+}
+
+// panelQuery is a fragment of the panel query which is queued or executed by the worker pool
+type panelQuery struct {
+	fragment  MetricQuery
+	mode      MergeMode
+	cancel    func()
+	cancelled atomic.Bool
+}
+
+// obsolete returns true if the query fragment doesn't contribute to the current query anymore
+func (q *panelQuery) obsolete(current MetricQuery) bool {
+	return q.fragment.Resolution != current.Resolution || q.fragment.EndTime.Before(current.StartTime) || q.fragment.StartTime.After(current.EndTime)
 }
 
 func SubscribeToPanels(
 	ctx context.Context,
 	dataSource DataSource,
+	sharedWorkerPool *SharedWorkerPool,
 	panelIds []string,
+	dashboardVariables []Variable,
 	commands <-chan MetricBoardCommands,
 	results chan<- MetricResult,
 ) {
 	var (
 		activePanelIds      = panelIds
+		visiblePanelIds     []string
 		activeQuery         *MetricQuery
-		previousQueries     = make(map[string]*MetricQuery)
+		requestId           string
+		previousQueries     = make(map[string]*IntervalSet) // ranges which were already loaded for every panel
 		previousQueriesLock sync.Mutex
 		refreshInterval     time.Duration
+		volatileBuckets     = DefaultVolatileBuckets
+		subscriptions       = make(map[string]*subscription)
+		subscriptionsEpoch  int // incremented on every cancellation in order to ignore subscriptions requested by stale queries
+		subscriptionsLock   sync.Mutex
+		pollingOnly         = make(map[string]bool)                // panels which data source can't stream; guarded by subscriptionsLock
+		pendingQueries      = make(map[string][]*panelQuery)       // guarded by previousQueriesLock
+		sentSeries          = make(map[string]map[string]Metric)   // series sent for every panel without points; guarded by previousQueriesLock
+		variables           = DefaultVariables(dashboardVariables) // replaced on every change since in-flight fragments keep reference to it
+		filters             = make(map[string]*SeriesFilter)
+		filtersLock         sync.Mutex
 	)
-	previousCtx, previousCancel := context.WithCancel(context.Background())
-	previousCancel()
+	panelFilter := func(panelId string) *SeriesFilter {
+		filtersLock.Lock()
+		defer filtersLock.Unlock()
+		return filters[panelId]
+	}
+	// resetFilter forgets top series of the panel which is reloaded from scratch
+	resetFilter := func(panelId string) {
+		filtersLock.Lock()
+		defer filtersLock.Unlock()
+		if filter, ok := filters[panelId]; ok {
+			filters[panelId] = filter.Unselected()
+		}
+	}
+	// send drops the result of the closed session, so workers of the shared pool never block on the client which is gone
+	send := func(result MetricResult) {
+		select {
+		case results <- result:
+		case <-ctx.Done():
+		}
+	}
+	panels, hasPanels := dataSource.(PanelProvider)
+	// queried and pushed metrics go through the same filters and group aggregates
+	dataSource = WithGroupAggregates(WithSeriesFilters(dataSource, panelFilter))
+	streamingDataSource, isStreaming := dataSource.(StreamingDataSource)
+	// trackSeries remembers identity of the sent series in order to notify client about its eviction later; must be called under previousQueriesLock
+	trackSeries := func(panelId string, metric Metric) {
+		if _, ok := sentSeries[panelId]; !ok {
+			sentSeries[panelId] = make(map[string]Metric)
+		}
+		sentSeries[panelId][metric.Key()] = Metric{PanelId: metric.PanelId, Type: metric.Type, Group: metric.Group, Labels: metric.Labels}
+	}
+	// trimWindow forgets points which fell out of the sliding window and notifies client about every affected series
+	trimWindow := func(windowStart time.Time) {
+		trimmed := make([]MetricResult, 0)
+		previousQueriesLock.Lock()
+		for panelId, loaded := range previousQueries {
+			if len(loaded.Intervals) == 0 || !loaded.Intervals[0].Start.Before(windowStart) {
+				continue
+			}
+			loaded.ForgetBefore(windowStart)
+			for _, series := range sentSeries[panelId] {
+				trimmed = append(trimmed, MetricResult{PanelId: panelId, Metric: series, TrimBefore: windowStart})
+			}
+		}
+		previousQueriesLock.Unlock()
+		for _, result := range trimmed {
+			send(result)
+		}
+	}
+	cancelSubscriptions := func(cancelled func(panelId string) bool) {
+		subscriptionsLock.Lock()
+		defer subscriptionsLock.Unlock()
+		subscriptionsEpoch++
+		for panelId, current := range subscriptions {
+			if cancelled(panelId) {
+				current.cancel()
+				delete(subscriptions, panelId)
+			}
+		}
+	}
+	// subscribe starts pushing of new panel points from the end of the query which was already loaded
+	subscribe := func(panelId string, query MetricQuery, epoch int) {
+		subscriptionsLock.Lock()
+		defer subscriptionsLock.Unlock()
+		if _, ok := subscriptions[panelId]; ok || pollingOnly[panelId] || epoch != subscriptionsEpoch {
+			return
+		}
+		subscriptionCtx, subscriptionCancel := context.WithCancel(ctx)
+		current := &subscription{resolution: query.Resolution, cancel: subscriptionCancel}
+		subscriptions[panelId] = current
+		Logger.Infof("subscribe to panel %v from %v", panelId, query.EndTime)
+		go func() {
+			defer subscriptionCancel()
+			err := ConsumeStream(func(metrics chan<- Metric) error {
+				return streamingDataSource.Subscribe(subscriptionCtx, panelId, query.EndTime, query.Resolution, metrics)
+			}, func(metric Metric) {
+				if len(metric.Timestamps) == 0 {
+					return
+				}
+				// pushed buckets are covered entirely, so points of the re-pushed bucket replace its partial value sent before
+				covered := Interval{
+					Start: time.UnixMicro(int64(metric.Timestamps[0])),
+					End:   time.UnixMicro(int64(metric.Timestamps[len(metric.Timestamps)-1])).Add(query.Resolution - time.Microsecond),
+				}
+				send(MetricResult{PanelId: panelId, Metric: metric, Mode: ReplaceMergeMode, Covered: covered, Resolution: query.Resolution})
+				previousQueriesLock.Lock()
+				trackSeries(panelId, metric)
+				if loaded := previousQueries[panelId]; loaded != nil && loaded.Resolution == query.Resolution {
+					loaded.Add(Interval{Start: query.EndTime, End: time.Now()})
+				}
+				previousQueriesLock.Unlock()
+			})
+			subscriptionsLock.Lock()
+			if subscriptions[panelId] == current {
+				delete(subscriptions, panelId)
+			}
+			if errors.Is(err, ErrStreamingNotSupported) {
+				pollingOnly[panelId] = true
+			}
+			subscriptionsLock.Unlock()
+			if err != nil && subscriptionCtx.Err() == nil && !errors.Is(err, ErrStreamingNotSupported) {
+				Logger.Errorf("data source subscription failed, fallback to polling: %v", err)
+				send(MetricResult{PanelId: panelId, Err: fmt.Errorf("data source subscription failed")})
+			}
+		}()
+	}
+	defer cancelSubscriptions(func(string) bool { return true })
+	// cancelQueries cancels pending queries which are not needed anymore; unaffected queries keep running
+	cancelQueries := func(cancelled func(panelId string, query *panelQuery) bool) {
+		previousQueriesLock.Lock()
+		defer previousQueriesLock.Unlock()
+		for panelId, pending := range pendingQueries {
+			pendingQueries[panelId] = slices.DeleteFunc(pending, func(query *panelQuery) bool {
+				if !cancelled(panelId, query) {
+					return false
+				}
+				query.cancelled.Store(true)
+				query.cancel()
+				return true
+			})
+		}
+	}
 
-	workerPool := NewWorkerPool(ctx, 1, 1024)
-	workerPool.Start()
-	defer workerPool.Stop()
+	workerPool := sharedWorkerPool.NewSession(ctx, DefaultSessionConcurrency)
+	defer workerPool.Close()
+	// tickers are created once and stay stopped until refresh interval or sliding window is set
+	refreshTicker := time.NewTicker(time.Hour)
+	refreshTicker.Stop()
+	defer refreshTicker.Stop()
+	trimTicker := time.NewTicker(WindowTrimInterval)
+	trimTicker.Stop()
+	defer trimTicker.Stop()
 loop:
 	for {
-		tick := time.Tick(refreshInterval)
+		var tick, trimTick <-chan time.Time
+		if refreshInterval > 0 {
+			tick = refreshTicker.C
+		}
+		if activeQuery != nil && activeQuery.Sliding() {
+			trimTick = trimTicker.C
+		}
 		select {
 		case <-ctx.Done():
 			Logger.Infof("context cancelled")
 			break loop
 		case <-tick:
 			Logger.Infof("period refresh triggered")
+			requestId = ""
+		case <-trimTick:
+			trimWindow(FixMetricQuery(time.Now(), *activeQuery).StartTime)
+			continue
 		case command, ok := <-commands:
 			if !ok {
 				break loop
 			}
+			requestId = command.Id
 			if command.TimeUpdate != nil {
 				Logger.Infof("receive time update command: %+v", *command.TimeUpdate)
-				if command.TimeUpdate.Start <= 0 || command.TimeUpdate.End < 0 || command.TimeUpdate.Resolution <= 0 {
-					results <- MetricResult{Err: fmt.Errorf("invalid time parameters: %+v", *command.TimeUpdate)}
+				query, err := ParseTimeUpdate(*command.TimeUpdate)
+				if err != nil {
+					send(MetricResult{RequestId: requestId, Err: err})
+					continue
+				}
+				resolved := ResolveMetricQuery(time.Now(), query)
+				start, end, resolution := resolved.StartTime.UnixMicro(), resolved.EndTime.UnixMicro(), resolved.Resolution.Microseconds()
+				if start <= 0 || command.TimeUpdate.End < 0 || command.TimeUpdate.Resolution < 0 || command.TimeUpdate.MaxPoints < 0 {
+					send(MetricResult{RequestId: requestId, Err: fmt.Errorf("invalid time parameters: %+v", *command.TimeUpdate)})
 					continue
 				}
-				if command.TimeUpdate.End != 0 && command.TimeUpdate.Start > command.TimeUpdate.End {
-					results <- MetricResult{Err: fmt.Errorf("start > time: %+v", *command.TimeUpdate)}
+				if start > end {
+					send(MetricResult{RequestId: requestId, Err: fmt.Errorf("start > time: %+v", *command.TimeUpdate)})
 					continue
 				}
-				if command.TimeUpdate.End != 0 && (command.TimeUpdate.End-command.TimeUpdate.Start)/command.TimeUpdate.Resolution > MaxPanelDataPoints {
-					results <- MetricResult{Err: fmt.Errorf("too many data points requested(%v): %+v", (command.TimeUpdate.End-command.TimeUpdate.Start)/command.TimeUpdate.Resolution, *command.TimeUpdate)}
+				if (end-start)/resolution > MaxPanelDataPoints {
+					send(MetricResult{RequestId: requestId, Err: fmt.Errorf("too many data points requested(%v): %+v", (end-start)/resolution, *command.TimeUpdate)})
 					continue
 				}
-				now := time.Now()
-				if command.TimeUpdate.End == 0 && (now.UnixMicro()-command.TimeUpdate.Start)/command.TimeUpdate.Resolution > MaxPanelDataPoints {
-					results <- MetricResult{Err: fmt.Errorf("too many data points requested(%v): %+v", (now.UnixMicro()-command.TimeUpdate.Start)/command.TimeUpdate.Resolution, *command.TimeUpdate)}
+				if command.TimeUpdate.Volatile != nil && *command.TimeUpdate.Volatile < 0 {
+					send(MetricResult{RequestId: requestId, Err: fmt.Errorf("invalid volatile parameter: %+v", *command.TimeUpdate.Volatile)})
 					continue
 				}
-				activeQuery = &MetricQuery{
-					StartTime:  time.UnixMicro(command.TimeUpdate.Start),
-					EndTime:    time.UnixMicro(command.TimeUpdate.End),
-					Resolution: time.Duration(command.TimeUpdate.Resolution) * time.Microsecond,
+				volatileBuckets = DefaultVolatileBuckets
+				if command.TimeUpdate.Volatile != nil {
+					volatileBuckets = *command.TimeUpdate.Volatile
 				}
+				activeQuery = &query
+				if query.Sliding() {
+					trimTicker.Reset(WindowTrimInterval)
+				} else {
+					trimTicker.Stop()
+				}
+				cancelSubscriptions(func(string) bool { return true })
 			}
 			if command.ConcurrencyUpdate != nil {
 				Logger.Infof("receive concurrency update command: %+v", *command.ConcurrencyUpdate)
-				if *command.RefreshUpdate < 0 {
-					results <- MetricResult{Err: fmt.Errorf("invalid concurrency parameter: %+v", *command.ConcurrencyUpdate)}
+				if *command.ConcurrencyUpdate <= 0 {
+					send(MetricResult{RequestId: requestId, Err: fmt.Errorf("invalid concurrency parameter: %+v", *command.ConcurrencyUpdate)})
 					continue
 				}
 				workerPool.Resize(*command.ConcurrencyUpdate)
@@ -91,19 +327,115 @@ loop:
 			if command.RefreshUpdate != nil {
 				Logger.Infof("receive refresh update command: %+v", *command.RefreshUpdate)
 				if *command.RefreshUpdate < 0 {
-					results <- MetricResult{Err: fmt.Errorf("invalid refresh parameter: %+v", *command.RefreshUpdate)}
+					send(MetricResult{RequestId: requestId, Err: fmt.Errorf("invalid refresh parameter: %+v", *command.RefreshUpdate)})
 					continue
 				}
 				refreshInterval = time.Duration(*command.RefreshUpdate) * time.Microsecond
+				if refreshInterval > 0 {
+					refreshTicker.Reset(refreshInterval)
+				} else {
+					refreshTicker.Stop()
+				}
 			}
 			if command.PanelsUpdate != nil {
 				Logger.Infof("receive panels update command: %+v", *command.PanelsUpdate)
+				filtersUpdate, err := NewSeriesFilters(command.PanelsUpdate.Filters)
+				if err != nil {
+					send(MetricResult{RequestId: requestId, Err: err})
+					continue
+				}
+				// panels with changed filters are reloaded from scratch since client already has series which are filtered out now
+				resetPanelIds := slices.Clone(command.PanelsUpdate.ResetPanelIds)
+				filtersLock.Lock()
+				for panelId, filter := range filtersUpdate {
+					if filter == nil {
+						delete(filters, panelId)
+					} else {
+						filters[panelId] = filter
+					}
+					resetPanelIds = append(resetPanelIds, panelId)
+				}
+				filtersLock.Unlock()
 				activePanelIds = command.PanelsUpdate.ActivePanelIds
-				for _, panelId := range command.PanelsUpdate.ResetPanelIds {
-					previousQueriesLock.Lock()
-					previousQueries[panelId] = nil
-					previousQueriesLock.Unlock()
+				cancelQueries(func(panelId string, query *panelQuery) bool {
+					return !slices.Contains(activePanelIds, panelId) || slices.Contains(resetPanelIds, panelId)
+				})
+				previousQueriesLock.Lock()
+				for _, panelId := range resetPanelIds {
+					delete(previousQueries, panelId)
+					delete(sentSeries, panelId)
+					resetFilter(panelId)
+				}
+				previousQueriesLock.Unlock()
+				// reset panels could change their definition, so their ability to stream is checked again
+				subscriptionsLock.Lock()
+				for _, panelId := range resetPanelIds {
+					delete(pollingOnly, panelId)
+				}
+				subscriptionsLock.Unlock()
+				visiblePanelIds = command.PanelsUpdate.VisiblePanelIds
+				workerPool.Reprioritize(func(panelId string) (int, bool) {
+					return panelPriority(visiblePanelIds, panelId), slices.Contains(activePanelIds, panelId)
+				})
+				cancelSubscriptions(func(panelId string) bool {
+					return !slices.Contains(activePanelIds, panelId) || slices.Contains(resetPanelIds, panelId)
+				})
+			}
+			if command.VariablesUpdate != nil {
+				Logger.Infof("receive variables update command: %+v", command.VariablesUpdate)
+				if err := ValidateVariableValues(dashboardVariables, command.VariablesUpdate); err != nil {
+					send(MetricResult{RequestId: requestId, Err: err})
+					continue
+				}
+				updated := maps.Clone(variables)
+				changed := make([]string, 0)
+				for name, value := range command.VariablesUpdate {
+					if current, ok := variables[name]; !ok || current != value {
+						changed = append(changed, name)
+					}
+					updated[name] = value
+				}
+				variables = updated
+				// panels which reference changed variables are re-queried from scratch, other panels keep their cache.
+				// Inactive panels are checked too, otherwise they would keep series of the old values after activation
+				cached := slices.Clone(activePanelIds)
+				previousQueriesLock.Lock()
+				for panelId := range previousQueries {
+					cached = append(cached, panelId)
+				}
+				for panelId := range sentSeries {
+					cached = append(cached, panelId)
+				}
+				for panelId := range pendingQueries {
+					cached = append(cached, panelId)
+				}
+				previousQueriesLock.Unlock()
+				affected := make(map[string]bool)
+				for _, panelId := range cached {
+					if _, ok := affected[panelId]; ok {
+						continue
+					}
+					if !hasPanels {
+						affected[panelId] = true
+						continue
+					}
+					referenced, err := PanelVariables(ctx, panels, panelId)
+					if err != nil {
+						Logger.Errorf("failed to get panel variables, reset panel: %v", err)
+					}
+					affected[panelId] = err != nil || slices.ContainsFunc(changed, func(name string) bool { return referenced[name] })
+				}
+				cancelQueries(func(panelId string, query *panelQuery) bool { return affected[panelId] })
+				previousQueriesLock.Lock()
+				for panelId := range affected {
+					if affected[panelId] {
+						delete(previousQueries, panelId)
+						delete(sentSeries, panelId)
+						resetFilter(panelId)
+					}
 				}
+				previousQueriesLock.Unlock()
+				cancelSubscriptions(func(panelId string) bool { return affected[panelId] })
 			}
 		}
 
@@ -112,44 +444,139 @@ loop:
 			continue
 		}
 
-		if previousCtx.Err() == nil {
-			Logger.Warnf("previous context cancelled although it wasn't fulfilled completely")
-			previousCancel()
+		now := time.Now()
+		currentQuery := FixMetricQuery(now, *activeQuery)
+		currentQuery.Variables = variables
+		cancelQueries(func(panelId string, query *panelQuery) bool { return query.obsolete(currentQuery) })
+		if activeQuery.Sliding() {
+			trimWindow(currentQuery.StartTime)
 		}
 
-		previousCtx, previousCancel = context.WithCancel(context.Background())
-		currentCtx, currentCancel := previousCtx, previousCancel
-
-		now := time.Now()
-		trigger := NewTrigger(func() { currentCancel() })
+		live := activeQuery.Live()
+		streaming := isStreaming && live
+		currentRequestId := requestId
+		trigger := NewTrigger(func() {
+			send(MetricResult{RequestId: currentRequestId, Complete: true})
+		})
 		for _, panelId := range activePanelIds {
+			subscriptionsLock.Lock()
+			current, subscribed := subscriptions[panelId]
+			if subscribed && current.resolution != currentQuery.Resolution {
+				Logger.Infof("resolution of panel %v changed, cancel its subscription", panelId)
+				current.cancel()
+				delete(subscriptions, panelId)
+				subscribed = false
+			}
+			epoch := subscriptionsEpoch
+			subscriptionsLock.Unlock()
+			if subscribed {
+				Logger.Infof("panel %v is streaming, skipping polling", panelId)
+				continue
+			}
+
+			// fragments which are still in flight are treated as already loaded
 			previousQueriesLock.Lock()
-			previousQuery := previousQueries[panelId]
+			loaded := previousQueries[panelId]
+			reset := loaded == nil || loaded.Resolution != currentQuery.Resolution
+			if reset {
+				loaded = NewIntervalSet(currentQuery.Resolution)
+				previousQueries[panelId] = loaded
+				delete(sentSeries, panelId)
+			}
+			// sent is a range of points which client received or will receive from the pending fragments
+			sent := loaded.Clone()
+			// trailing buckets of the live query can still receive late points, so they are re-queried on every refresh
+			if live && volatileBuckets > 0 && len(loaded.Intervals) > 0 {
+				resolution := currentQuery.Resolution.Microseconds()
+				last := loaded.Intervals[len(loaded.Intervals)-1].End.UnixMicro()
+				loaded.ForgetAfter(time.UnixMicro(last - last%resolution - int64(volatileBuckets-1)*resolution))
+			}
+			covered := loaded.Clone()
+			for _, pending := range pendingQueries[panelId] {
+				covered.Add(Interval{Start: pending.fragment.StartTime, End: pending.fragment.EndTime})
+				sent.Add(Interval{Start: pending.fragment.StartTime, End: pending.fragment.EndTime})
+			}
+			missing := covered.Missing(Interval{Start: currentQuery.StartTime, End: currentQuery.EndTime})
 			previousQueriesLock.Unlock()
 
-			fragmentQuery, fullQuery := AdjustMetricQuery(now, previousQuery, *activeQuery)
-			if fragmentQuery == nil {
-				Logger.Infof("redundant query requested, skipping it: previous=%v, active=%v", previousQuery, activeQuery)
+			if len(missing) == 0 {
+				Logger.Infof("redundant query requested, skipping it: loaded=%v, active=%v", covered.Intervals, currentQuery)
 				continue
 			}
-			Logger.Infof("put metric query '%+v' for panel %v in queue", fragmentQuery, panelId)
+			if reset {
+				send(MetricResult{RequestId: currentRequestId, PanelId: panelId, Mode: ResetMergeMode, Covered: Interval{Start: currentQuery.StartTime, End: currentQuery.EndTime}, Resolution: currentQuery.Resolution})
+			}
+
+			var (
+				panelCancelled atomic.Bool
+				panelFailed    atomic.Bool
+			)
 			trigger.Add()
-			go workerPool.Exec(func(ctx context.Context) {
+			panelTrigger := NewTrigger(func() {
 				defer trigger.Done()
-
-				ctx = CombineContexts(currentCtx, ctx)
-				metrics := NewStreamingWriter[Metric](ctx, 0, func(metric Metric) { results <- MetricResult{PanelId: panelId, Metric: metric} })
-				err := dataSource.GetMetric(ctx, panelId, *fragmentQuery, metrics)
-				close(metrics)
-				if err != nil {
-					Logger.Errorf("data source failed: %v", err)
-					results <- MetricResult{PanelId: panelId, Err: fmt.Errorf("data source failed")}
+				if panelCancelled.Load() {
+					send(MetricResult{RequestId: currentRequestId, PanelId: panelId, Cancelled: true})
 					return
 				}
+				send(MetricResult{RequestId: currentRequestId, PanelId: panelId, Complete: true})
+				if !panelFailed.Load() && streaming {
+					subscribe(panelId, currentQuery, epoch)
+				}
+			})
+			priority := panelPriority(visiblePanelIds, panelId)
+			for _, interval := range missing {
+				queryCtx, queryCancel := context.WithCancel(ctx)
+				query := &panelQuery{
+					fragment: MetricQuery{StartTime: interval.Start, EndTime: interval.End, Resolution: currentQuery.Resolution, Variables: currentQuery.Variables},
+					cancel:   queryCancel,
+				}
+				query.mode = sent.MergeMode(interval)
 				previousQueriesLock.Lock()
-				previousQueries[panelId] = &fullQuery
+				pendingQueries[panelId] = append(pendingQueries[panelId], query)
 				previousQueriesLock.Unlock()
-			})
+
+				Logger.Infof("put metric query '%+v' for panel %v in queue", query.fragment, panelId)
+				panelTrigger.Add()
+				go func() {
+					defer panelTrigger.Done()
+					defer queryCancel()
+
+					var err error
+					executed := workerPool.ExecPriority(panelId, priority, func(ctx context.Context) {
+						ctx = CombineContexts(queryCtx, ctx)
+						err = ConsumeStream(func(metrics chan<- Metric) error {
+							return dataSource.GetMetric(ctx, panelId, query.fragment, metrics)
+						}, func(metric Metric) {
+							if !query.cancelled.Load() {
+								send(MetricResult{RequestId: currentRequestId, PanelId: panelId, Metric: metric, Mode: query.mode, Covered: interval, Resolution: query.fragment.Resolution})
+								previousQueriesLock.Lock()
+								trackSeries(panelId, metric)
+								previousQueriesLock.Unlock()
+							}
+						})
+					})
+
+					previousQueriesLock.Lock()
+					pendingQueries[panelId] = slices.DeleteFunc(pendingQueries[panelId], func(pending *panelQuery) bool { return pending == query })
+					cancelled := query.cancelled.Load() || !executed
+					if loaded := previousQueries[panelId]; !cancelled && err == nil && loaded != nil && loaded.Resolution == query.fragment.Resolution {
+						loaded.Add(Interval{Start: query.fragment.StartTime, End: query.fragment.EndTime})
+					}
+					previousQueriesLock.Unlock()
+
+					if cancelled {
+						Logger.Infof("query for panel %v was cancelled: %+v", panelId, query.fragment)
+						panelCancelled.Store(true)
+						return
+					}
+					if err != nil {
+						Logger.Errorf("data source failed: %v", err)
+						panelFailed.Store(true)
+						send(MetricResult{RequestId: currentRequestId, PanelId: panelId, Err: fmt.Errorf("data source failed")})
+					}
+				}()
+			}
+			panelTrigger.Activate()
 		}
 		trigger.Activate()
 	}
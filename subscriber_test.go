@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func receiveUntil(t *testing.T, results <-chan MetricResult, last func(result MetricResult) bool) []MetricResult {
+	received := make([]MetricResult, 0)
+	for {
+		select {
+		case result := <-results:
+			received = append(received, result)
+			if last(result) {
+				return received
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected result wasn't received: received=%+v", received)
+		}
+	}
+}
+
+func receiveUntilComplete(t *testing.T, results <-chan MetricResult, requestId string) []MetricResult {
+	return receiveUntil(t, results, func(result MetricResult) bool {
+		return result.Complete && result.PanelId == "" && result.RequestId == requestId
+	})
+}
+
+func newTestWorkerPool(t *testing.T) *SharedWorkerPool {
+	pool := NewSharedWorkerPool(context.Background(), 4)
+	pool.Start()
+	t.Cleanup(pool.Stop)
+	return pool
+}
+
+type blockingDataSource struct {
+	release chan struct{}
+}
+
+func (s blockingDataSource) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.release:
+	}
+	metrics <- Metric{PanelId: panelId, Type: InstanceMetricLineType, Timestamps: []uint64{uint64(query.StartTime.UnixMicro())}, Values: []float32{1}}
+	return nil
+}
+
+// pushingDataSource has no points to query and pushes metrics of the channel to the subscriptions
+type pushingDataSource struct {
+	pushes chan Metric
+}
+
+func (s pushingDataSource) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
+	return nil
+}
+
+func (s pushingDataSource) Subscribe(ctx context.Context, panelId string, from time.Time, resolution time.Duration, metrics chan<- Metric) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case metric := <-s.pushes:
+			metrics <- metric
+		}
+	}
+}
+
+// endlessDataSource streams points of the panel until the query is cancelled
+type endlessDataSource struct {
+	started chan struct{}
+}
+
+func (s endlessDataSource) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
+	close(s.started)
+	for i := uint64(0); ; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case metrics <- Metric{PanelId: panelId, Type: InstanceMetricLineType, Timestamps: []uint64{i}, Values: []float32{1}}:
+		}
+	}
+}
+
+// pollingDataSource is a streaming data source which panels can be only polled
+type pollingDataSource struct {
+	subscribes *atomic.Int32
+}
+
+func (s pollingDataSource) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
+	metrics <- Metric{PanelId: panelId, Type: InstanceMetricLineType, Timestamps: []uint64{uint64(query.StartTime.UnixMicro())}, Values: []float32{1}}
+	return nil
+}
+
+func (s pollingDataSource) Subscribe(ctx context.Context, panelId string, from time.Time, resolution time.Duration, metrics chan<- Metric) error {
+	s.subscribes.Add(1)
+	return ErrStreamingNotSupported
+}
+
+type variablesMetricBoard struct {
+	MockMetricBoard
+	panels staticPanels
+}
+
+func (b variablesMetricBoard) GetPanel(ctx context.Context, panelId string) (Panel, error) {
+	return b.panels[panelId], nil
+}
+
+func (b variablesMetricBoard) GetMetric(ctx context.Context, panelId string, query MetricQuery, metrics chan<- Metric) error {
+	labels := map[string]string{"host": SubstituteVariables("$host", query.Variables)}
+	metrics <- Metric{PanelId: panelId, Type: InstanceMetricLineType, Labels: labels, Timestamps: []uint64{uint64(query.StartTime.UnixMicro())}, Values: []float32{1}}
+	return nil
+}
+
+func TestSubscribeToPanels(t *testing.T) {
+	t.Run("request correlation", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		commands := make(chan MetricBoardCommands)
+		results := make(chan MetricResult, 1024)
+		go SubscribeToPanels(ctx, MockMetricBoard{}, newTestWorkerPool(t), []string{"p-1", "p-2"}, nil, commands, results)
+
+		commands <- MetricBoardCommands{Id: "1", TimeUpdate: &MetricBoardTimeUpdateCommand{Start: 1_000_000, End: 61_000_000, Resolution: 1_000_000}}
+		received := receiveUntilComplete(t, results, "1")
+		panels := make(map[string]int)
+		completed := make(map[string]bool)
+		for _, result := range received {
+			require.Equal(t, "1", result.RequestId)
+			require.Nil(t, result.Err)
+			if result.Complete {
+				completed[result.PanelId] = true
+				continue
+			}
+			require.False(t, completed[result.PanelId], "metric after panel completion")
+			require.Equal(t, time.Second, result.Resolution)
+			panels[result.PanelId] += len(result.Metric.Timestamps)
+		}
+		require.Equal(t, map[string]int{"p-1": 61, "p-2": 61}, panels)
+		require.Equal(t, map[string]bool{"p-1": true, "p-2": true, "": true}, completed)
+
+		commands <- MetricBoardCommands{Id: "2", TimeUpdate: &MetricBoardTimeUpdateCommand{Start: 2_000_000, End: 1_000_000, Resolution: 1_000_000}}
+		result := <-results
+		require.Equal(t, "2", result.RequestId)
+		require.NotNil(t, result.Err)
+	})
+	t.Run("streaming", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		storage := NewMemoryStorage(0)
+		start := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+		require.Nil(t, storage.Append("p-1", "", nil, []uint64{uint64(start.UnixMicro())}, []float32{1}))
+
+		commands := make(chan MetricBoardCommands)
+		results := make(chan MetricResult, 1024)
+		go SubscribeToPanels(ctx, storage, newTestWorkerPool(t), []string{"p-1"}, nil, commands, results)
+		commands <- MetricBoardCommands{Id: "1", TimeUpdate: &MetricBoardTimeUpdateCommand{Start: start.UnixMicro(), Resolution: 1000}}
+		received := receiveUntilComplete(t, results, "1")
+		require.Equal(t, ResetMergeMode, received[0].Mode)
+		require.Equal(t, []float32{1}, received[1].Metric.Values)
+
+		// subscription is established asynchronously after the initial query completion
+		require.Eventually(t, func() bool {
+			storage.lock.RLock()
+			defer storage.lock.RUnlock()
+			return len(storage.listeners["p-1"]) > 0
+		}, 5*time.Second, time.Millisecond)
+		pushed := time.Now().Truncate(time.Millisecond)
+		require.Nil(t, storage.Append("p-1", "", nil, []uint64{uint64(pushed.UnixMicro())}, []float32{2}))
+		select {
+		case result := <-results:
+			require.Equal(t, "p-1", result.PanelId)
+			require.Equal(t, []uint64{uint64(pushed.UnixMicro())}, result.Metric.Timestamps)
+			require.Equal(t, []float32{2}, result.Metric.Values)
+			require.Equal(t, ReplaceMergeMode, result.Mode)
+			require.Equal(t, Interval{Start: pushed, End: pushed.Add(time.Millisecond - time.Microsecond)}, result.Covered)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("pushed point wasn't delivered")
+		}
+	})
+	t.Run("streaming skips empty pushes", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		dataSource := pushingDataSource{pushes: make(chan Metric)}
+		commands := make(chan MetricBoardCommands)
+		results := make(chan MetricResult, 1024)
+		go SubscribeToPanels(ctx, dataSource, newTestWorkerPool(t), []string{"p-1"}, nil, commands, results)
+		commands <- MetricBoardCommands{Id: "1", TimeUpdate: &MetricBoardTimeUpdateCommand{Start: time.Now().Add(-time.Minute).UnixMicro(), Resolution: 1_000_000}}
+		receiveUntilComplete(t, results, "1")
+
+		dataSource.pushes <- Metric{PanelId: "p-1", Type: InstanceMetricLineType}
+		dataSource.pushes <- Metric{PanelId: "p-1", Type: InstanceMetricLineType, Timestamps: []uint64{1_000_000}, Values: []float32{1}}
+		received := receiveUntil(t, results, func(result MetricResult) bool { return result.Metric.Timestamps != nil })
+		require.Len(t, received, 1)
+		require.Equal(t, []float32{1}, received[0].Metric.Values)
+	})
+	t.Run("panels without streaming are polled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		dataSource := pollingDataSource{subscribes: &atomic.Int32{}}
+		commands := make(chan MetricBoardCommands)
+		results := make(chan MetricResult, 1024)
+		go SubscribeToPanels(ctx, dataSource, newTestWorkerPool(t), []string{"p-1"}, nil, commands, results)
+		commands <- MetricBoardCommands{Id: "1", TimeUpdate: &MetricBoardTimeUpdateCommand{Start: time.Now().Add(-time.Minute).UnixMicro(), Resolution: 1_000_000}}
+		receiveUntilComplete(t, results, "1")
+		refresh := func(id int) bool {
+			commands <- MetricBoardCommands{Id: strconv.Itoa(id)}
+			received := receiveUntilComplete(t, results, strconv.Itoa(id))
+			return slices.ContainsFunc(received, func(result MetricResult) bool { return result.PanelId == "p-1" && result.Complete })
+		}
+		// panel is skipped until its failed subscription is removed asynchronously
+		id := 2
+		for ; !refresh(id); id++ {
+			require.Less(t, id, 1000)
+		}
+		for i := 0; i < 3; i++ {
+			require.True(t, refresh(id+1+i))
+		}
+		require.Equal(t, int32(1), dataSource.subscribes.Load())
+	})
+	t.Run("disconnected session releases shared worker", func(t *testing.T) {
+		pool := NewSharedWorkerPool(context.Background(), 1)
+		pool.Start()
+		t.Cleanup(pool.Stop)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		dataSource := endlessDataSource{started: make(chan struct{})}
+		commands := make(chan MetricBoardCommands)
+		// client stops reading results in the middle of the panel stream
+		results := make(chan MetricResult)
+		go SubscribeToPanels(ctx, dataSource, pool, []string{"p-1"}, nil, commands, results)
+		commands <- MetricBoardCommands{Id: "1", TimeUpdate: &MetricBoardTimeUpdateCommand{Start: time.Now().Add(-time.Minute).UnixMicro(), Resolution: 1_000_000}}
+		receiveUntil(t, results, func(result MetricResult) bool { return result.Mode == ResetMergeMode })
+		receive(t, dataSource.started)
+		cancel()
+
+		executed := make(chan bool)
+		go func() { executed <- pool.NewSession(context.Background(), 1).Exec(func(ctx context.Context) {}) }()
+		require.True(t, receive(t, executed))
+	})
+	t.Run("cancel superseded panels only", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		dataSource := blockingDataSource{release: make(chan struct{})}
+		commands := make(chan MetricBoardCommands)
+		results := make(chan MetricResult, 1024)
+		go SubscribeToPanels(ctx, dataSource, newTestWorkerPool(t), []string{"p-1", "p-2"}, nil, commands, results)
+
+		concurrency := 2
+		commands <- MetricBoardCommands{Id: "1", ConcurrencyUpdate: &concurrency, TimeUpdate: &MetricBoardTimeUpdateCommand{Start: 1_000_000, End: 2_000_000, Resolution: 1_000_000}}
+		commands <- MetricBoardCommands{Id: "2", PanelsUpdate: &MetricBoardPanelsUpdateCommand{ActivePanelIds: []string{"p-1"}}}
+
+		received := receiveUntil(t, results, func(result MetricResult) bool { return result.Cancelled })
+		require.Equal(t, MetricResult{RequestId: "1", PanelId: "p-2", Cancelled: true}, received[len(received)-1])
+		for _, result := range received {
+			require.Empty(t, result.Metric.Values)
+		}
+
+		close(dataSource.release)
+		received = slices.DeleteFunc(receiveUntilComplete(t, results, "1"), func(result MetricResult) bool { return result.RequestId != "1" })
+		require.Len(t, received, 3)
+		require.Equal(t, "p-1", received[0].PanelId)
+		require.Equal(t, []float32{1}, received[0].Metric.Values)
+		require.Equal(t, MetricResult{RequestId: "1", PanelId: "p-1", Complete: true}, received[1])
+	})
+	t.Run("zoom out fetches missing ranges only", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		commands := make(chan MetricBoardCommands)
+		results := make(chan MetricResult, 1024)
+		go SubscribeToPanels(ctx, MockMetricBoard{}, newTestWorkerPool(t), []string{"p-1"}, nil, commands, results)
+
+		commands <- MetricBoardCommands{Id: "1", TimeUpdate: &MetricBoardTimeUpdateCommand{Start: 20_000_000, End: 30_000_000, Resolution: 1_000_000}}
+		receiveUntilComplete(t, results, "1")
+		commands <- MetricBoardCommands{Id: "2", TimeUpdate: &MetricBoardTimeUpdateCommand{Start: 10_000_000, End: 40_000_000, Resolution: 1_000_000}}
+		timestamps := make([]uint64, 0)
+		modes := make(map[MergeMode]Interval)
+		for _, result := range receiveUntilComplete(t, results, "2") {
+			timestamps = append(timestamps, result.Metric.Timestamps...)
+			if len(result.Metric.Timestamps) > 0 {
+				modes[result.Mode] = result.Covered
+			}
+		}
+		require.Equal(t, map[MergeMode]Interval{
+			PrependMergeMode: {Start: time.UnixMicro(10_000_000), End: time.UnixMicro(19_999_999)},
+			AppendMergeMode:  {Start: time.UnixMicro(30_000_001), End: time.UnixMicro(40_000_000)},
+		}, modes)
+		slices.Sort(timestamps)
+		require.Len(t, timestamps, 20)
+		require.Equal(t, uint64(10_000_000), timestamps[0])
+		require.Equal(t, uint64(19_000_000), timestamps[9])
+		require.Equal(t, uint64(31_000_000), timestamps[10])
+		require.Equal(t, uint64(40_000_000), timestamps[19])
+	})
+	t.Run("live refresh re-queries volatile buckets", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		storage := NewMemoryStorage(0)
+		bucket := time.Now().Truncate(time.Second)
+		require.Nil(t, storage.Append("p-1", "", nil, []uint64{uint64(bucket.UnixMicro())}, []float32{1}))
+
+		commands := make(chan MetricBoardCommands)
+		results := make(chan MetricResult, 1024)
+		// hide Subscribe method of the storage in order to force polling
+		go SubscribeToPanels(ctx, struct{ DataSource }{storage}, newTestWorkerPool(t), []string{"p-1"}, nil, commands, results)
+		volatile := 2
+		commands <- MetricBoardCommands{Id: "1", TimeUpdate: &MetricBoardTimeUpdateCommand{Start: bucket.Add(-10 * time.Second).UnixMicro(), Resolution: 1_000_000, Volatile: &volatile}}
+		received := receiveUntilComplete(t, results, "1")
+		require.Equal(t, ResetMergeMode, received[0].Mode)
+		require.Equal(t, []float32{1}, received[1].Metric.Values)
+		require.Equal(t, AppendMergeMode, received[1].Mode)
+
+		require.Nil(t, storage.Append("p-1", "", nil, []uint64{uint64(bucket.UnixMicro()) + 1}, []float32{3}))
+		commands <- MetricBoardCommands{Id: "2"}
+		received = receiveUntilComplete(t, results, "2")
+		require.Equal(t, []uint64{uint64(bucket.UnixMicro())}, received[0].Metric.Timestamps)
+		require.Equal(t, []float32{2}, received[0].Metric.Values)
+		require.Equal(t, ReplaceMergeMode, received[0].Mode)
+		require.False(t, received[0].Covered.Start.After(bucket))
+	})
+	t.Run("sliding window eviction", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		commands := make(chan MetricBoardCommands)
+		results := make(chan MetricResult, 1024)
+		go SubscribeToPanels(ctx, MockMetricBoard{}, newTestWorkerPool(t), []string{"p-1"}, nil, commands, results)
+
+		start := time.Now()
+		commands <- MetricBoardCommands{Id: "1", TimeUpdate: &MetricBoardTimeUpdateCommand{Window: 3_000_000, Resolution: 1_000_000}}
+		receiveUntilComplete(t, results, "1")
+		received := receiveUntil(t, results, func(result MetricResult) bool { return !result.TrimBefore.IsZero() })
+		trim := received[len(received)-1]
+		require.Equal(t, "p-1", trim.PanelId)
+		require.Equal(t, Metric{PanelId: "p-1", Type: InstanceMetricLineType}, trim.Metric)
+		require.True(t, trim.TrimBefore.After(start.Add(-3*time.Second)))
+
+		commands <- MetricBoardCommands{Id: "2", TimeUpdate: &MetricBoardTimeUpdateCommand{Start: start.UnixMicro(), Window: 3_000_000, End: start.UnixMicro() + 1, Resolution: 1_000_000}}
+		received = receiveUntil(t, results, func(result MetricResult) bool { return result.RequestId == "2" })
+		require.NotNil(t, received[len(received)-1].Err)
+	})
+	t.Run("refresh of sliding window", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		commands := make(chan MetricBoardCommands)
+		results := make(chan MetricResult, 1024)
+		go SubscribeToPanels(ctx, MockMetricBoard{}, newTestWorkerPool(t), []string{"p-1"}, nil, commands, results)
+
+		// refresh interval is longer than the trim interval, so trimming must not postpone the refresh
+		refresh := int(WindowTrimInterval.Microseconds() * 3 / 2)
+		commands <- MetricBoardCommands{Id: "1", RefreshUpdate: &refresh, TimeUpdate: &MetricBoardTimeUpdateCommand{Window: 3_000_000, Resolution: 1_000_000}}
+		receiveUntilComplete(t, results, "1")
+		receiveUntilComplete(t, results, "")
+	})
+	t.Run("variables update re-runs referencing panels", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		board := variablesMetricBoard{panels: staticPanels{
+			"p-1": Panel{Id: "p-1", Query: `up{host="$host"}`},
+			"p-2": Panel{Id: "p-2", Query: "up"},
+			"p-3": Panel{Id: "p-3", Expression: `sum("p-1")`},
+		}}
+		commands := make(chan MetricBoardCommands)
+		results := make(chan MetricResult, 1024)
+		variables := []Variable{{Name: "host", Default: "a", Values: []string{"a", "b"}}, {Name: "unused", Default: "x"}}
+		go SubscribeToPanels(ctx, board, newTestWorkerPool(t), []string{"p-1", "p-2", "p-3"}, variables, commands, results)
+
+		// session starts with default values of the variables
+		commands <- MetricBoardCommands{Id: "1", TimeUpdate: &MetricBoardTimeUpdateCommand{Start: 1_000_000, End: 5_000_000, Resolution: 1_000_000}}
+		for _, result := range receiveUntilComplete(t, results, "1") {
+			if result.Metric.Timestamps != nil {
+				require.Equal(t, map[string]string{"host": "a"}, result.Metric.Labels)
+			}
+		}
+
+		for i, invalid := range []map[string]string{{"cluster": "a"}, {"host": `a"} or up{host="`}} {
+			requestId := fmt.Sprintf("invalid-%v", i)
+			commands <- MetricBoardCommands{Id: requestId, VariablesUpdate: invalid}
+			failed := receiveUntil(t, results, func(result MetricResult) bool { return result.RequestId == requestId })
+			require.NotNil(t, failed[len(failed)-1].Err)
+		}
+
+		commands <- MetricBoardCommands{Id: "2", VariablesUpdate: map[string]string{"host": "b", "unused": "x"}}
+		reset := make(map[string]bool)
+		for _, result := range receiveUntilComplete(t, results, "2") {
+			if result.Mode == ResetMergeMode {
+				reset[result.PanelId] = true
+			} else if result.Metric.Timestamps != nil {
+				require.Equal(t, map[string]string{"host": "b"}, result.Metric.Labels)
+			}
+		}
+		require.Equal(t, map[string]bool{"p-1": true, "p-3": true}, reset)
+
+		commands <- MetricBoardCommands{Id: "3", VariablesUpdate: map[string]string{"host": "b"}}
+		received := receiveUntilComplete(t, results, "3")
+		require.Len(t, received, 1)
+
+		// inactive panel which references changed variable is re-queried after activation
+		commands <- MetricBoardCommands{Id: "4", PanelsUpdate: &MetricBoardPanelsUpdateCommand{ActivePanelIds: []string{"p-2"}}}
+		receiveUntilComplete(t, results, "4")
+		commands <- MetricBoardCommands{Id: "5", VariablesUpdate: map[string]string{"host": "a"}}
+		receiveUntilComplete(t, results, "5")
+		commands <- MetricBoardCommands{Id: "6", PanelsUpdate: &MetricBoardPanelsUpdateCommand{ActivePanelIds: []string{"p-1", "p-2"}}}
+		reset = make(map[string]bool)
+		for _, result := range receiveUntilComplete(t, results, "6") {
+			if result.Mode == ResetMergeMode {
+				reset[result.PanelId] = true
+			} else if result.Metric.Timestamps != nil {
+				require.Equal(t, map[string]string{"host": "a"}, result.Metric.Labels)
+			}
+		}
+		require.Equal(t, map[string]bool{"p-1": true}, reset)
+	})
+	t.Run("panel filters", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		series := func(host string, value float32) Metric {
+			return Metric{Type: InstanceMetricLineType, Labels: map[string]string{"host": host}, Timestamps: []uint64{1_000_000}, Values: []float32{value}}
+		}
+		dataSource := panelDataSource{"p-1": {series("a", 1), series("b", 3), series("c", 2)}, "p-2": {series("a", 1), series("b", 3)}}
+		commands := make(chan MetricBoardCommands)
+		results := make(chan MetricResult, 1024)
+		go SubscribeToPanels(ctx, dataSource, newTestWorkerPool(t), []string{"p-1", "p-2"}, nil, commands, results)
+		received := func(requestId string) map[string][]string {
+			hosts := make(map[string][]string)
+			for _, result := range receiveUntilComplete(t, results, requestId) {
+				require.Nil(t, result.Err)
+				if result.Mode == ResetMergeMode || result.Metric.Timestamps != nil {
+					hosts[result.PanelId] = append(hosts[result.PanelId], result.Metric.Labels["host"])
+				}
+			}
+			return hosts
+		}
+
+		commands <- MetricBoardCommands{
+			Id:           "1",
+			TimeUpdate:   &MetricBoardTimeUpdateCommand{Start: 1_000_000, End: 5_000_000, Resolution: 1_000_000},
+			PanelsUpdate: &MetricBoardPanelsUpdateCommand{ActivePanelIds: []string{"p-1", "p-2"}, Filters: map[string]PanelFilter{"p-1": {TopK: 1}}},
+		}
+		require.Equal(t, map[string][]string{"p-1": {"", "b"}, "p-2": {"", "a", "b"}}, received("1"))
+
+		commands <- MetricBoardCommands{Id: "2", PanelsUpdate: &MetricBoardPanelsUpdateCommand{
+			ActivePanelIds: []string{"p-1", "p-2"},
+			Filters:        map[string]PanelFilter{"p-1": {Matchers: []LabelMatcher{{Label: "host", Op: "!=", Value: "b"}}}},
+		}}
+		require.Equal(t, map[string][]string{"p-1": {"", "a", "c"}}, received("2"))
+
+		commands <- MetricBoardCommands{Id: "3", PanelsUpdate: &MetricBoardPanelsUpdateCommand{
+			ActivePanelIds: []string{"p-1", "p-2"},
+			Filters:        map[string]PanelFilter{"p-2": {Matchers: []LabelMatcher{{Label: "host", Op: "=~", Value: "("}}}},
+		}}
+		failed := receiveUntil(t, results, func(result MetricResult) bool { return result.RequestId == "3" })
+		require.NotNil(t, failed[len(failed)-1].Err)
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeOffset is a shift of the time: calendar part is applied in the timezone of the query in order to respect DST
+type timeOffset struct {
+	Duration time.Duration
+	Days     int
+	Months   int
+}
+
+// TimeExpression is either absolute time or expression relative to now() like now-6h or now-1d/d
+type TimeExpression struct {
+	Relative bool
+	Absolute time.Time
+	Offsets  []timeOffset
+	Round    string // unit for calendar alignment of the relative time; empty if alignment is not needed
+}
+
+var timeUnits = map[byte]timeOffset{
+	's': {Duration: time.Second},
+	'm': {Duration: time.Minute},
+	'h': {Duration: time.Hour},
+	'd': {Days: 1},
+	'w': {Days: 7},
+	'M': {Months: 1},
+	'y': {Months: 12},
+}
+
+// ParseTimeExpression parses time expression which is one of:
+// - absolute time in microseconds since epoch or in RFC3339 format
+// - now() followed by offsets with units s, m, h, d, w, M, y and optional alignment by unit: now-1d/d
+func ParseTimeExpression(expression string) (TimeExpression, error) {
+	expression = strings.TrimSpace(expression)
+	if !strings.HasPrefix(expression, "now") {
+		if micros, err := strconv.ParseInt(expression, 10, 64); err == nil {
+			return TimeExpression{Absolute: time.UnixMicro(micros)}, nil
+		}
+		absolute, err := time.Parse(time.RFC3339, expression)
+		if err != nil {
+			return TimeExpression{}, fmt.Errorf("invalid time expression: expression=%v, err=%w", expression, err)
+		}
+		return TimeExpression{Absolute: absolute}, nil
+	}
+	parsed := TimeExpression{Relative: true}
+	rest := expression[len("now"):]
+	for len(rest) > 0 {
+		if rest[0] == '/' {
+			if len(rest) != 2 {
+				return TimeExpression{}, fmt.Errorf("invalid time alignment: expression=%v", expression)
+			}
+			if _, ok := timeUnits[rest[1]]; !ok {
+				return TimeExpression{}, fmt.Errorf("invalid time alignment: expression=%v", expression)
+			}
+			parsed.Round = rest[1:]
+			break
+		}
+		if rest[0] != '+' && rest[0] != '-' {
+			return TimeExpression{}, fmt.Errorf("invalid time offset: expression=%v", expression)
+		}
+		digits := 1
+		for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+			digits++
+		}
+		amount, err := strconv.Atoi(rest[:digits])
+		if err != nil || digits == len(rest) {
+			return TimeExpression{}, fmt.Errorf("invalid time offset: expression=%v", expression)
+		}
+		unit, ok := timeUnits[rest[digits]]
+		if !ok {
+			return TimeExpression{}, fmt.Errorf("invalid time unit: expression=%v, unit=%c", expression, rest[digits])
+		}
+		parsed.Offsets = append(parsed.Offsets, timeOffset{
+			Duration: unit.Duration * time.Duration(amount),
+			Days:     unit.Days * amount,
+			Months:   unit.Months * amount,
+		})
+		rest = rest[digits+1:]
+	}
+	return parsed, nil
+}
+
+// IsNow returns true if expression always resolves to now() exactly
+func (e TimeExpression) IsNow() bool {
+	return e.Relative && len(e.Offsets) == 0 && e.Round == ""
+}
+
+// Resolve returns absolute time of the expression; aligned time is rounded to the end of the unit period if roundUp is set
+func (e TimeExpression) Resolve(now time.Time, location *time.Location, roundUp bool) time.Time {
+	if !e.Relative {
+		return e.Absolute
+	}
+	resolved := now.In(location)
+	for _, offset := range e.Offsets {
+		resolved = addMonths(resolved, offset.Months).AddDate(0, 0, offset.Days).Add(offset.Duration)
+	}
+	if e.Round == "" {
+		return resolved
+	}
+	year, month, day := resolved.Date()
+	var start, next time.Time
+	switch e.Round {
+	case "s", "m", "h":
+		unit := timeUnits[e.Round[0]].Duration
+		start = time.Date(year, month, day, 0, 0, 0, 0, location).Add(resolved.Sub(time.Date(year, month, day, 0, 0, 0, 0, location)).Truncate(unit))
+		next = start.Add(unit)
+	case "d":
+		start = time.Date(year, month, day, 0, 0, 0, 0, location)
+		next = start.AddDate(0, 0, 1)
+	case "w":
+		start = time.Date(year, month, day-(int(resolved.Weekday())+6)%7, 0, 0, 0, 0, location)
+		next = start.AddDate(0, 0, 7)
+	case "M":
+		start = time.Date(year, month, 1, 0, 0, 0, 0, location)
+		next = start.AddDate(0, 1, 0)
+	case "y":
+		start = time.Date(year, time.January, 1, 0, 0, 0, 0, location)
+		next = start.AddDate(1, 0, 0)
+	}
+	if roundUp {
+		return next.Add(-time.Microsecond)
+	}
+	return start
+}
+
+// addMonths shifts the time by calendar months clamping the day to the length of the target month: now-1M at March 31 is February 29
+func addMonths(t time.Time, months int) time.Time {
+	if months == 0 {
+		return t
+	}
+	year, month, day := t.Date()
+	lastDay := time.Date(year, month+time.Month(months)+1, 0, 0, 0, 0, 0, t.Location()).Day()
+	hour, minute, second := t.Clock()
+	return time.Date(year, month+time.Month(months), min(day, lastDay), hour, minute, second, t.Nanosecond(), t.Location())
+}
+
+// ParseTimeUpdate converts time command into the query; relative boundaries are kept unresolved
+func ParseTimeUpdate(command MetricBoardTimeUpdateCommand) (MetricQuery, error) {
+	query := MetricQuery{
+		StartTime:  time.UnixMicro(command.Start),
+		EndTime:    time.UnixMicro(command.End),
+		Resolution: time.Duration(command.Resolution) * time.Microsecond,
+		MaxPoints:  min(command.MaxPoints, MaxPanelDataPoints),
+	}
+	if query.MaxPoints <= 0 && command.Resolution == 0 {
+		query.MaxPoints = DefaultAutoMaxPoints
+	} else if query.MaxPoints <= 0 {
+		// explicit resolution is kept as long as it fits into the hard limit
+		query.MaxPoints = MaxPanelDataPoints
+	}
+	if command.Window < 0 || (command.Window > 0 && (command.End != 0 || command.From != "" || command.To != "")) {
+		return MetricQuery{}, fmt.Errorf("invalid window parameter: %+v", command)
+	}
+	if command.Window > 0 {
+		query.From = &TimeExpression{Relative: true, Offsets: []timeOffset{{Duration: -time.Duration(command.Window) * time.Microsecond}}}
+	}
+	if command.From != "" {
+		from, err := ParseTimeExpression(command.From)
+		if err != nil {
+			return MetricQuery{}, err
+		}
+		query.From = &from
+	}
+	if command.To != "" {
+		to, err := ParseTimeExpression(command.To)
+		if err != nil {
+			return MetricQuery{}, err
+		}
+		query.To = &to
+	}
+	if command.Timezone != "" {
+		location, err := time.LoadLocation(command.Timezone)
+		if err != nil {
+			return MetricQuery{}, fmt.Errorf("invalid timezone: timezone=%v, err=%w", command.Timezone, err)
+		}
+		query.Location = location
+	}
+	return query, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeExpression(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.Nil(t, err)
+	now := time.Date(2024, time.March, 31, 12, 34, 56, 0, berlin)
+	resolve := func(expression string, location *time.Location, roundUp bool) time.Time {
+		parsed, err := ParseTimeExpression(expression)
+		require.Nil(t, err)
+		return parsed.Resolve(now, location, roundUp)
+	}
+
+	require.Equal(t, now.Add(-6*time.Hour).UnixMicro(), resolve("now-6h", berlin, false).UnixMicro())
+	require.Equal(t, now.UnixMicro(), resolve("now", time.UTC, false).UnixMicro())
+	require.Equal(t, time.Date(2024, time.March, 30, 0, 0, 0, 0, berlin).UnixMicro(), resolve("now-1d/d", berlin, false).UnixMicro())
+	require.Equal(t, time.Date(2024, time.March, 31, 0, 0, 0, 0, berlin).UnixMicro()-1, resolve("now-1d/d", berlin, true).UnixMicro())
+	// DST switch happens on 2024-03-31 in Berlin, so calendar day is 23 hours long
+	require.Equal(t, time.Date(2024, time.March, 30, 12, 34, 56, 0, berlin).UnixMicro(), resolve("now-1d", berlin, false).UnixMicro())
+	require.Equal(t, time.Date(2024, time.March, 25, 0, 0, 0, 0, berlin).UnixMicro(), resolve("now/w", berlin, false).UnixMicro())
+	require.Equal(t, time.Date(2024, time.February, 1, 0, 0, 0, 0, berlin).UnixMicro(), resolve("now-1M/M", berlin, false).UnixMicro())
+	require.Equal(t, time.Date(2024, time.February, 29, 12, 34, 56, 0, berlin).UnixMicro(), resolve("now-1M", berlin, false).UnixMicro())
+	require.Equal(t, time.Date(2024, time.March, 31, 12, 0, 0, 0, berlin).UnixMicro(), resolve("now/h", berlin, false).UnixMicro())
+	require.Equal(t, time.Date(2024, time.March, 31, 10, 0, 0, 0, time.UTC).UnixMicro(), resolve("now/h", time.UTC, false).UnixMicro())
+	require.Equal(t, int64(1_000_000), resolve("1000000", time.UTC, false).UnixMicro())
+
+	for _, invalid := range []string{"now-", "now-h", "now-1x", "now/", "now/dd", "now*2", "yesterday"} {
+		_, err := ParseTimeExpression(invalid)
+		require.NotNil(t, err, invalid)
+	}
+
+	query, err := ParseTimeUpdate(MetricBoardTimeUpdateCommand{From: "now-1d/d", To: "now-1d/d", Timezone: "Europe/Berlin", Resolution: 1_000_000})
+	require.Nil(t, err)
+	require.True(t, query.Sliding())
+	require.False(t, query.Live())
+	resolved := ResolveMetricQuery(now, query)
+	require.Equal(t, time.Date(2024, time.March, 30, 0, 0, 0, 0, berlin).UnixMicro(), resolved.StartTime.UnixMicro())
+	require.Equal(t, time.Date(2024, time.March, 31, 0, 0, 0, 0, berlin).UnixMicro()-1, resolved.EndTime.UnixMicro())
+
+	query, err = ParseTimeUpdate(MetricBoardTimeUpdateCommand{From: "now-6h", To: "now", Resolution: 1_000_000})
+	require.Nil(t, err)
+	require.True(t, query.Live())
+
+	_, err = ParseTimeUpdate(MetricBoardTimeUpdateCommand{From: "now-6h", Timezone: "Mars/Olympus"})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"time"
+)
+
+// VariableDiscoveryWindow is a range before now() which is queried in order to discover values of the variable
+const VariableDiscoveryWindow = time.Hour
+
+var (
+	variableName     = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	templateVariable = regexp.MustCompile(`\$([a-zA-Z_][a-zA-Z0-9_]*)\b`)
+)
+
+// Variable of the dashboard is referenced as $name from panel queries. Its values are either listed statically or
+// discovered from the label of the panel series
+type Variable struct {
+	Name    string   `json:"name"`
+	Default string   `json:"default,omitempty"`
+	Values  []string `json:"values,omitempty"`
+	Panel   string   `json:"panel,omitempty"`
+	Label   string   `json:"label,omitempty"`
+	// Free variable accepts any value from the client; values are substituted into the query text as is, so it must be
+	// used only with data sources which bind variables as query parameters
+	Free bool `json:"free,omitempty"`
+}
+
+// ValidateVariables checks that variables have unique names and a single source of values
+func ValidateVariables(variables []Variable) error {
+	names := make(map[string]struct{})
+	for _, variable := range variables {
+		if !variableName.MatchString(variable.Name) {
+			return fmt.Errorf("invalid variable name: name=%v", variable.Name)
+		}
+		if _, ok := names[variable.Name]; ok {
+			return fmt.Errorf("duplicate variable: name=%v", variable.Name)
+		}
+		names[variable.Name] = struct{}{}
+		if (variable.Panel == "") != (variable.Label == "") {
+			return fmt.Errorf("panel and label must be set together: name=%v", variable.Name)
+		}
+		if variable.Panel != "" && len(variable.Values) > 0 {
+			return fmt.Errorf("variable values must be either static or discovered: name=%v", variable.Name)
+		}
+	}
+	return nil
+}
+
+// TemplateVariables returns names of the variables referenced in the text
+func TemplateVariables(text string) []string {
+	names := make([]string, 0)
+	for _, match := range templateVariable.FindAllStringSubmatch(text, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// SubstituteVariables replaces $name references with values of the variables; unknown references are kept as is
+func SubstituteVariables(text string, variables map[string]string) string {
+	return templateVariable.ReplaceAllStringFunc(text, func(reference string) string {
+		if value, ok := variables[reference[1:]]; ok {
+			return value
+		}
+		return reference
+	})
+}
+
+// ValidateVariableValues checks that values are assigned only to the declared variables and belong to the listed
+// (or discovered) values of the variable or to its default value, unless the variable is free
+func ValidateVariableValues(variables []Variable, values map[string]string) error {
+	declared := make(map[string]Variable, len(variables))
+	for _, variable := range variables {
+		declared[variable.Name] = variable
+	}
+	for name, value := range values {
+		variable, ok := declared[name]
+		if !ok {
+			return fmt.Errorf("undeclared variable: name=%v", name)
+		}
+		if !variable.Free && value != variable.Default && !slices.Contains(variable.Values, value) {
+			return fmt.Errorf("value of the variable is not allowed: name=%v, value=%v", name, value)
+		}
+	}
+	return nil
+}
+
+// PanelVariables returns names of the variables referenced by the panel query or by queries of the panels selected by its expression
+func PanelVariables(ctx context.Context, panels PanelProvider, panelId string) (map[string]bool, error) {
+	names := make(map[string]bool)
+	visited := make(map[string]bool)
+	var visit func(panelId string) error
+	visit = func(panelId string) error {
+		if visited[panelId] {
+			return nil
+		}
+		visited[panelId] = true
+		panel, err := panels.GetPanel(ctx, panelId)
+		if err != nil {
+			return fmt.Errorf("failed to get panel: id=%v, err=%w", panelId, err)
+		}
+		for _, name := range TemplateVariables(panel.Query) {
+			names[name] = true
+		}
+		if panel.Expression == "" {
+			return nil
+		}
+		expression, err := ParseExpression(panel.Expression)
+		if err != nil {
+			return fmt.Errorf("invalid panel expression: id=%v, err=%w", panelId, err)
+		}
+		for _, selected := range ExpressionPanels(expression) {
+			if err := visit(selected); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return names, visit(panelId)
+}
+
+// DiscoverVariableValues returns sorted distinct values of the variable label among series of the variable panel
+func DiscoverVariableValues(ctx context.Context, dataSource DataSource, variable Variable, query MetricQuery) ([]string, error) {
+	distinct := make(map[string]struct{})
+	err := ConsumeStream(func(metrics chan<- Metric) error {
+		return dataSource.GetMetric(ctx, variable.Panel, query, metrics)
+	}, func(metric Metric) {
+		if value, ok := metric.Labels[variable.Label]; ok {
+			distinct[value] = struct{}{}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover variable values: name=%v, err=%w", variable.Name, err)
+	}
+	values := make([]string, 0, len(distinct))
+	for value := range distinct {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// DefaultVariables returns default values of the variables
+func DefaultVariables(variables []Variable) map[string]string {
+	defaults := make(map[string]string, len(variables))
+	for _, variable := range variables {
+		defaults[variable.Name] = variable.Default
+	}
+	return defaults
+}
+
+// ResolveDashboardVariables fills values of the discovered variables of the dashboard; discovery queries are
+// executed by the worker pool with default values of all variables. Variables which failed to be discovered are left without values
+func ResolveDashboardVariables(workerPool *WorkerPoolSession, dataSource DataSource, dashboard Dashboard, now time.Time) Dashboard {
+	query := MetricQuery{StartTime: now.Add(-VariableDiscoveryWindow), EndTime: now, Resolution: VariableDiscoveryWindow / 60, Variables: DefaultVariables(dashboard.Variables)}
+	variables := make([]Variable, len(dashboard.Variables))
+	for i, variable := range dashboard.Variables {
+		variables[i] = variable
+		if variable.Panel == "" {
+			continue
+		}
+		var (
+			values []string
+			err    error
+		)
+		executed := workerPool.Exec(func(ctx context.Context) {
+			values, err = DiscoverVariableValues(ctx, dataSource, variable, query)
+		})
+		if !executed {
+			err = fmt.Errorf("discovery query was dropped: name=%v", variable.Name)
+		}
+		if err != nil {
+			Logger.Errorf("failed to discover dashboard variable: dashboard=%v, err=%v", dashboard.Id, err)
+			continue
+		}
+		variables[i].Values = values
+	}
+	dashboard.Variables = variables
+	return dashboard
+}
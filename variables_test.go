@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVariables(t *testing.T) {
+	require.Equal(t, `up{cluster="x", host="$host"} $`, SubstituteVariables(`up{cluster="$cluster", host="$host"} $`, map[string]string{"cluster": "x"}))
+	require.Equal(t, []string{"cluster", "host"}, TemplateVariables(`up{cluster="$cluster", host="$host"}`))
+
+	require.Nil(t, ValidateVariables([]Variable{{Name: "cluster", Values: []string{"x", "y"}}, {Name: "host", Panel: "p", Label: "host"}}))
+	require.NotNil(t, ValidateVariables([]Variable{{Name: "$cluster"}}))
+	require.NotNil(t, ValidateVariables([]Variable{{Name: "cluster"}, {Name: "cluster"}}))
+	require.NotNil(t, ValidateVariables([]Variable{{Name: "host", Panel: "p"}}))
+	require.NotNil(t, ValidateVariables([]Variable{{Name: "host", Panel: "p", Label: "host", Values: []string{"a"}}}))
+
+	declared := []Variable{{Name: "cluster", Default: "x", Values: []string{"y"}}, {Name: "query", Free: true}}
+	require.Nil(t, ValidateVariableValues(declared, map[string]string{"cluster": "x", "query": `"}) or vector(1`}))
+	require.Nil(t, ValidateVariableValues(declared, map[string]string{"cluster": "y"}))
+	require.NotNil(t, ValidateVariableValues(declared, map[string]string{"cluster": `y"} or up{a="`}))
+	require.NotNil(t, ValidateVariableValues(declared, map[string]string{"host": "a"}))
+
+	panels := staticPanels{
+		"requests":   Panel{Id: "requests", Query: `requests{cluster="$cluster"}`},
+		"errors":     Panel{Id: "errors", Query: `errors{host="$host"}`},
+		"ratio":      Panel{Id: "ratio", Expression: "errors / requests + ratio_base"},
+		"ratio_base": Panel{Id: "ratio_base", Expression: "ratio"},
+	}
+	referenced, err := PanelVariables(context.Background(), panels, "ratio")
+	require.Nil(t, err)
+	require.Equal(t, map[string]bool{"cluster": true, "host": true}, referenced)
+
+	dashboard := Dashboard{Id: "d", Variables: []Variable{
+		{Name: "cluster", Default: "x", Values: []string{"x", "y"}},
+		{Name: "host", Panel: "hosts", Label: "host"},
+	}}
+	dataSource := panelDataSource{"hosts": {
+		{Type: InstanceMetricLineType, Labels: map[string]string{"host": "b"}},
+		{Type: InstanceMetricLineType, Labels: map[string]string{"host": "a"}},
+		{Type: InstanceMetricLineType, Labels: map[string]string{"host": "b"}},
+		{Type: InstanceMetricLineType},
+	}}
+	workerPool := newTestWorkerPool(t).NewSession(context.Background(), 1)
+	resolved := ResolveDashboardVariables(workerPool, dataSource, dashboard, time.Now())
+	require.Equal(t, []string{"x", "y"}, resolved.Variables[0].Values)
+	require.Equal(t, []string{"a", "b"}, resolved.Variables[1].Values)
+	require.Nil(t, dashboard.Variables[1].Values)
+
+	// discovery is skipped when worker pool session is closed
+	workerPool.Close()
+	resolved = ResolveDashboardVariables(workerPool, dataSource, dashboard, time.Now())
+	require.Nil(t, resolved.Variables[1].Values)
+}
@@ -6,73 +6,180 @@ import (
 )
 
 type work struct {
-	f    func()
-	done chan<- struct{}
+	f        func()
+	done     chan<- struct{}
+	key      string
+	priority int
+	executed bool
 }
 
-type WorkerPool struct {
-	sync.RWMutex
+// SharedWorkerPool executes work of many sessions with limited total concurrency.
+// Free workers pick sessions in round-robin order so every session with pending work gets a fair share of the pool
+type SharedWorkerPool struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
 	size     int
-	capacity int
-	queries  chan work
+	sessions []*WorkerPoolSession
+	next     int
+	stopped  bool
 	ctx      context.Context
 	cancel   func()
 }
 
-func NewWorkerPool(ctx context.Context, size int, capacity int) *WorkerPool {
+// WorkerPoolSession is a fair-share queue of the SharedWorkerPool with its own concurrency limit
+type WorkerPoolSession struct {
+	pool    *SharedWorkerPool
+	limit   int
+	running int
+	queue   []*work
+	ctx     context.Context
+	cancel  func()
+}
+
+func NewSharedWorkerPool(ctx context.Context, size int) *SharedWorkerPool {
 	ctx, cancel := context.WithCancel(ctx)
-	return &WorkerPool{
-		size:     size,
-		capacity: capacity,
-		queries:  make(chan work, capacity),
-		ctx:      ctx,
-		cancel:   cancel,
+	pool := &SharedWorkerPool{size: size, ctx: ctx, cancel: cancel}
+	pool.cond = sync.NewCond(&pool.lock)
+	return pool
+}
+
+func (p *SharedWorkerPool) Start() {
+	for i := 0; i < p.size; i++ {
+		go p.worker()
 	}
 }
 
-func worker(queries <-chan work) {
-	Logger.Infof("started worker")
-	for query := range queries {
+func (p *SharedWorkerPool) Stop() {
+	p.cancel()
+	p.lock.Lock()
+	p.stopped = true
+	p.lock.Unlock()
+	p.cond.Broadcast()
+}
+
+// pick returns next session which has pending work and didn't reach its limit; must be called under the lock
+func (p *SharedWorkerPool) pick() *WorkerPoolSession {
+	for i := 0; i < len(p.sessions); i++ {
+		session := p.sessions[(p.next+i)%len(p.sessions)]
+		if len(session.queue) > 0 && session.running < session.limit {
+			p.next = (p.next + i + 1) % len(p.sessions)
+			return session
+		}
+	}
+	return nil
+}
+
+func (p *SharedWorkerPool) worker() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for {
+		session := p.pick()
+		for session == nil && !p.stopped {
+			p.cond.Wait()
+			session = p.pick()
+		}
+		if p.stopped {
+			return
+		}
+		query := session.pop()
+		query.executed = true
+		session.running++
+		p.lock.Unlock()
+
 		query.f()
 		close(query.done)
+
+		p.lock.Lock()
+		session.running--
+		p.cond.Broadcast()
 	}
-	Logger.Infof("finished worker")
 }
 
-func (p *WorkerPool) Start() {
-	for i := 0; i < p.size; i++ {
-		go worker(p.queries)
-	}
+func (p *SharedWorkerPool) NewSession(ctx context.Context, limit int) *WorkerPoolSession {
+	ctx, cancel := context.WithCancel(CombineContexts(ctx, p.ctx))
+	session := &WorkerPoolSession{pool: p, limit: min(limit, p.size), ctx: ctx, cancel: cancel}
+	p.lock.Lock()
+	p.sessions = append(p.sessions, session)
+	p.lock.Unlock()
+	return session
 }
 
-func (p *WorkerPool) Stop() {
-	p.cancel()
-	close(p.queries)
+// Close removes session from the pool and drops all its pending work without execution
+func (s *WorkerPoolSession) Close() {
+	s.cancel()
+	s.pool.lock.Lock()
+	for _, query := range s.queue {
+		close(query.done)
+	}
+	s.queue = nil
+	for i, session := range s.pool.sessions {
+		if session == s {
+			s.pool.sessions = append(s.pool.sessions[:i], s.pool.sessions[i+1:]...)
+			break
+		}
+	}
+	s.pool.next = 0
+	s.pool.lock.Unlock()
 }
 
-func (p *WorkerPool) Resize(size int) {
-	if p.size == size {
-		return
+// pop removes first work with the highest priority from the queue; must be called under the pool lock
+func (s *WorkerPoolSession) pop() *work {
+	best := 0
+	for i, query := range s.queue {
+		if query.priority > s.queue[best].priority {
+			best = i
+		}
 	}
-	p.Lock()
-	close(p.queries)
-	previous := p.queries
-	p.size = size
-	p.queries = make(chan work, p.capacity)
-	p.Unlock()
-
-	p.Start()
-	for query := range previous {
-		p.queries <- query
+	query := s.queue[best]
+	s.queue = append(s.queue[:best], s.queue[best+1:]...)
+	return query
+}
+
+// Reprioritize updates priorities of all pending work by their keys and drops work for which keep is false
+func (s *WorkerPoolSession) Reprioritize(update func(key string) (priority int, keep bool)) {
+	s.pool.lock.Lock()
+	queue := s.queue[:0]
+	for _, query := range s.queue {
+		priority, keep := update(query.key)
+		if !keep {
+			close(query.done)
+			continue
+		}
+		query.priority = priority
+		queue = append(queue, query)
 	}
+	s.queue = queue
+	s.pool.lock.Unlock()
+}
+
+// Resize changes maximum number of session work items executed concurrently; it never exceeds size of the pool
+func (s *WorkerPoolSession) Resize(limit int) {
+	s.pool.lock.Lock()
+	s.limit = min(limit, s.pool.size)
+	s.pool.lock.Unlock()
+	s.pool.cond.Broadcast()
 }
 
-func (p *WorkerPool) Exec(f func(ctx context.Context)) {
+func (s *WorkerPoolSession) Exec(f func(ctx context.Context)) bool {
+	return s.ExecPriority("", 0, f)
+}
+
+// ExecPriority waits until f is executed before any pending work of the session with lower priority.
+// Work can be identified by the key in order to change its priority later.
+// Returns false if work was dropped without execution
+func (s *WorkerPoolSession) ExecPriority(key string, priority int, f func(ctx context.Context)) bool {
 	done := make(chan struct{})
+	query := &work{f: func() { f(s.ctx) }, done: done, key: key, priority: priority}
 
-	p.RLock()
-	p.queries <- work{f: func() { f(p.ctx) }, done: done}
-	p.RUnlock()
+	s.pool.lock.Lock()
+	if s.ctx.Err() != nil {
+		s.pool.lock.Unlock()
+		return false
+	}
+	s.queue = append(s.queue, query)
+	s.pool.lock.Unlock()
+	s.pool.cond.Signal()
 
 	<-done
+	return query.executed
 }
@@ -16,78 +16,155 @@ func TestName(t *testing.T) {
 	}
 }
 
-func TestWorkerPool(t *testing.T) {
-	t.Run("1 worker", func(t *testing.T) {
-		results := make(chan int, 3)
-		p := NewWorkerPool(context.Background(), 1, 1024)
+// waitQueued waits until the session has exactly n pending work items
+func waitQueued(t *testing.T, session *WorkerPoolSession, n int) {
+	require.Eventually(t, func() bool {
+		session.pool.lock.Lock()
+		defer session.pool.lock.Unlock()
+		return len(session.queue) == n
+	}, 5*time.Second, time.Millisecond)
+}
+
+func receive[T any](t *testing.T, items <-chan T) T {
+	select {
+	case item := <-items:
+		return item
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected item wasn't received")
+	}
+	panic("unreachable")
+}
+
+func TestSharedWorkerPool(t *testing.T) {
+	t.Run("session limit", func(t *testing.T) {
+		p := NewSharedWorkerPool(context.Background(), 4)
 		p.Start()
-		startTime := time.Now()
-		go p.Exec(func(ctx context.Context) {
-			time.Sleep(1 * time.Second)
-			results <- 1
-		})
-		go p.Exec(func(ctx context.Context) {
-			time.Sleep(1 * time.Second)
-			results <- 2
-		})
-		go p.Exec(func(ctx context.Context) {
-			time.Sleep(1 * time.Second)
-			results <- 3
-		})
-		sum := 0
+		defer p.Stop()
+		session := p.NewSession(context.Background(), 1)
+		defer session.Close()
+
+		started, release := make(chan int, 3), make(chan struct{})
 		for i := 0; i < 3; i++ {
-			sum += <-results
+			value := i
+			go session.Exec(func(ctx context.Context) {
+				started <- value
+				<-release
+			})
 		}
-		require.Greater(t, time.Since(startTime), 2*time.Second)
-		require.Less(t, time.Since(startTime), 4*time.Second)
-		require.Equal(t, 1+2+3, sum)
-	})
-	t.Run("3 worker", func(t *testing.T) {
-		results := make(chan int, 3)
-		p := NewWorkerPool(context.Background(), 3, 1024)
-		p.Start()
-		startTime := time.Now()
-		go p.Exec(func(ctx context.Context) {
-			time.Sleep(1 * time.Second)
-			results <- 1
-		})
-		go p.Exec(func(ctx context.Context) {
-			time.Sleep(1 * time.Second)
-			results <- 2
-		})
-		go p.Exec(func(ctx context.Context) {
-			time.Sleep(1 * time.Second)
-			results <- 3
-		})
-		sum := 0
+		receive(t, started)
+		// other work waits for the running one although the pool has free workers
+		waitQueued(t, session, 2)
+		require.Len(t, started, 0)
+		close(release)
+		receive(t, started)
+		receive(t, started)
+
+		session.Resize(3)
+		release = make(chan struct{})
 		for i := 0; i < 3; i++ {
-			sum += <-results
+			go session.Exec(func(ctx context.Context) {
+				started <- 0
+				<-release
+			})
+		}
+		for i := 0; i < 3; i++ {
+			receive(t, started)
 		}
-		require.Greater(t, time.Since(startTime), 1*time.Second)
-		require.Less(t, time.Since(startTime), 2*time.Second)
-		require.Equal(t, 1+2+3, sum)
+		close(release)
+
+		session.Resize(10)
+		p.lock.Lock()
+		require.Equal(t, 4, session.limit)
+		p.lock.Unlock()
 	})
-	t.Run("resize", func(t *testing.T) {
-		results := make(chan int, 16)
-		p := NewWorkerPool(context.Background(), 1, 1024)
+	t.Run("fair share", func(t *testing.T) {
+		p := NewSharedWorkerPool(context.Background(), 1)
 		p.Start()
-		startTime := time.Now()
-		for i := 0; i < 16; i++ {
-			value := i
-			go p.Exec(func(ctx context.Context) {
-				time.Sleep(1 * time.Second)
-				results <- value
-			})
+		defer p.Stop()
+		a := p.NewSession(context.Background(), 1)
+		defer a.Close()
+		b := p.NewSession(context.Background(), 1)
+		defer b.Close()
+
+		order := make(chan string, 11)
+		started, release := make(chan struct{}), make(chan struct{})
+		go a.Exec(func(ctx context.Context) {
+			close(started)
+			<-release
+			order <- "a"
+		})
+		<-started
+		for i := 0; i < 9; i++ {
+			go a.Exec(func(ctx context.Context) { order <- "a" })
 		}
-		time.Sleep(1 * time.Second)
-		p.Resize(16)
+		waitQueued(t, a, 9)
+		go b.Exec(func(ctx context.Context) { order <- "b" })
+		waitQueued(t, b, 1)
+		close(release)
 
-		sum := 0
-		for i := 0; i < 16; i++ {
-			sum += <-results
+		position := 0
+		for i := 0; i < 11; i++ {
+			if receive(t, order) == "b" {
+				position = i
+			}
 		}
-		require.Greater(t, time.Since(startTime), 2*time.Second)
-		require.Less(t, time.Since(startTime), 4*time.Second)
-		require.Equal(t, 16*15/2, sum)
+		// b is picked right after the running work of a although a has earlier pending work
+		require.Equal(t, 1, position)
+	})
+	t.Run("close drops pending work", func(t *testing.T) {
+		p := NewSharedWorkerPool(context.Background(), 1)
+		p.Start()
+		defer p.Stop()
+		session := p.NewSession(context.Background(), 1)
+
+		started := make(chan struct{})
+		go session.Exec(func(ctx context.Context) {
+			close(started)
+			<-ctx.Done()
+		})
+		<-started
+		executed := make(chan bool, 1)
+		go func() { executed <- session.Exec(func(ctx context.Context) {}) }()
+		waitQueued(t, session, 1)
+		session.Close()
+		require.False(t, receive(t, executed))
+	})
+	t.Run("priority", func(t *testing.T) {
+		p := NewSharedWorkerPool(context.Background(), 1)
+		p.Start()
+		defer p.Stop()
+		session := p.NewSession(context.Background(), 1)
+		defer session.Close()
+
+		started, release := make(chan struct{}), make(chan struct{})
+		go session.Exec(func(ctx context.Context) {
+			close(started)
+			<-release
+		})
+		<-started
+
+		order := make(chan string, 3)
+		dropped := make(chan bool, 1)
+		go session.ExecPriority("low", 0, func(ctx context.Context) { order <- "low" })
+		go session.ExecPriority("high", 1, func(ctx context.Context) { order <- "high" })
+		go func() { dropped <- !session.ExecPriority("hidden", 1, func(ctx context.Context) { order <- "hidden" }) }()
+		go session.ExecPriority("promoted", 0, func(ctx context.Context) { order <- "promoted" })
+		waitQueued(t, session, 4)
+		session.Reprioritize(func(key string) (int, bool) {
+			switch key {
+			case "hidden":
+				return 0, false
+			case "promoted":
+				return 2, true
+			case "high":
+				return 1, true
+			}
+			return 0, true
+		})
+		require.True(t, receive(t, dropped))
+		close(release)
+		require.Equal(t, "promoted", receive(t, order))
+		require.Equal(t, "high", receive(t, order))
+		require.Equal(t, "low", receive(t, order))
 	})
 }